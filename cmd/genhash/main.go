@@ -6,19 +6,37 @@ import (
 	"fmt"
 
 	scrypt "github.com/agnivade/easy-scrypt"
+	"github.com/agnivade/perseus/internal/scram"
 )
 
 func main() {
-	var pass string
+	var pass, mechanism string
+	var iterations int
 	flag.StringVar(&pass, "password", "test", "Password to hash.")
+	flag.StringVar(&mechanism, "mechanism", "scrypt", "Hashing mechanism. One of scrypt or scram-sha-256.")
+	flag.IntVar(&iterations, "iterations", scram.DefaultIterations, "Iteration count for scram-sha-256.")
 	flag.Parse()
 
-	hashBytes, err := scrypt.DerivePassphrase(pass, 32)
-	if err != nil {
-		fmt.Println(err)
+	var hashStr string
+	switch mechanism {
+	case "scrypt":
+		hashBytes, err := scrypt.DerivePassphrase(pass, 32)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		hashStr = base64.StdEncoding.EncodeToString(hashBytes)
+	case "scram-sha-256":
+		verifier, err := scram.NewVerifier(pass, iterations)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		hashStr = verifier.String()
+	default:
+		fmt.Printf("Unknown mechanism %q\n", mechanism)
 		return
 	}
 
-	hashStr := base64.StdEncoding.EncodeToString(hashBytes)
 	fmt.Printf("Your hash is %q (without the quotes)\n", hashStr)
 }
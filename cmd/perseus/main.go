@@ -18,7 +18,11 @@ func main() {
 	flag.StringVar(&configFile, "config", "config/config.json", "Configuration file for the Perseus service.")
 	flag.Parse()
 
-	cfg, err := config.Parse(configFile)
+	loadConfig := func() (config.Config, error) {
+		return config.Parse(configFile)
+	}
+
+	cfg, err := loadConfig()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "could not parse config file: %s\n", err)
 		os.Exit(1)
@@ -29,6 +33,8 @@ func main() {
 		fmt.Fprintf(os.Stderr, "could not start the server: %s\n", err)
 		os.Exit(1)
 	}
+	s.SetConfigLoader(loadConfig)
+
 	sigShutdown := make(chan os.Signal, 1)
 	signal.Notify(sigShutdown, os.Interrupt, syscall.SIGTERM)
 
@@ -51,7 +57,7 @@ func main() {
 	go func() {
 		defer reloadWg.Done()
 		for range sigReload {
-			cfg, err := config.Parse(configFile)
+			cfg, err := loadConfig()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "could not parse config file: %s\n", err)
 				continue
@@ -11,10 +11,91 @@ import (
 // Config is the configuration for a perseus server.
 type Config struct {
 	ListenAddress    string
+	LogSettings      LogSettings
+	TLSSettings      TLSSettings
 	AWSSettings      AWSSettings
 	AuthDBSettings   AuthDBSettings
+	SecuritySettings SecuritySettings
+	AdminSettings    AdminSettings
+	MetricsSettings  MetricsSettings
+	ClusterSettings  ClusterSettings
 	PoolSettings     PoolSettings
 	OverrideSettings map[string]PoolSettings
+	// TenantSettings are keyed by "source_db/source_schema".
+	TenantSettings map[string]TenantSettings
+}
+
+// LogSettings controls logging.
+type LogSettings struct {
+	// Level is one of "debug", "info", "warn" or "error". Defaults to "info".
+	// It can be changed on reload.
+	Level string
+	// Format is either "text" or "json". Defaults to "text".
+	Format string
+}
+
+// TLSSettings controls TLS termination for client connections.
+// TLS is enabled when both CertFile and KeyFile are set.
+type TLSSettings struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, if set, requires clients to present a certificate
+	// signed by one of the CAs in this file.
+	ClientCAFile string
+	// MinVersion is one of "1.0", "1.1", "1.2" or "1.3". Defaults to "1.2".
+	MinVersion string
+	// Require rejects clients which do not upgrade to TLS.
+	Require bool
+}
+
+// SecuritySettings controls the protection against brute forcing logins.
+type SecuritySettings struct {
+	// MaxFailedLogins is the number of failed logins from a source IP, or for a
+	// database and schema, after which further logins are locked out. A
+	// successful login only forgets the failures of its database and schema.
+	// Zero disables lockouts.
+	MaxFailedLogins int
+	// FailureWindowSecs is the time after which a failed login is forgotten.
+	FailureWindowSecs int
+	// LockoutSecs is the duration of the first lockout. It doubles with every
+	// consecutive lockout, up to MaxLockoutSecs.
+	LockoutSecs    int
+	MaxLockoutSecs int
+	// MaxConcurrentVerifications caps the number of password verifications
+	// running at the same time. Zero means no limit.
+	MaxConcurrentVerifications int
+}
+
+// AdminSettings controls the admin console. It is a virtual database
+// which can be connected to with psql to inspect Perseus.
+// The console is disabled if User is empty.
+type AdminSettings struct {
+	// Database is the name of the virtual database. Defaults to "perseus".
+	Database string
+	User     string
+	// PasswordHashed is generated by cmd/genhash, in either format.
+	PasswordHashed string
+}
+
+// MetricsSettings controls the Prometheus metrics endpoint.
+type MetricsSettings struct {
+	// ListenAddress is the address of the HTTP listener serving /metrics.
+	// Metrics are not served if it is empty.
+	ListenAddress string
+}
+
+// ClusterSettings let several Perseus instances behind a load balancer
+// forward cancel requests to each other, since a cancel request can reach
+// another instance than the one its client is connected to.
+type ClusterSettings struct {
+	// InstanceID identifies this instance, from 0 to 255. It is encoded in
+	// the key data sent to clients, so it has to be unique in the cluster.
+	InstanceID int
+	// Peers are the addresses of the instances, indexed by their InstanceID,
+	// so that every instance can share the same list. Cancel requests for
+	// the clients of another instance are forwarded to it, unless they
+	// come from a peer.
+	Peers []string
 }
 
 type AWSSettings struct {
@@ -33,11 +114,179 @@ type PoolSettings struct {
 	ConnCreateTimeoutSecs int
 	ConnCloseTimeoutSecs  int
 	SchemaExecTimeoutSecs int
+	// QueryWaitTimeoutSecs is the maximum time a client waits for a server
+	// connection when all of them are in use. Zero means wait forever.
+	QueryWaitTimeoutSecs int
+	// MaxWaitQueue is the maximum number of clients which can wait for a
+	// server connection per pool. Zero means no limit.
+	MaxWaitQueue int
+	// PoolMode decides how long a client keeps a server connection.
+	// One of "session", "transaction" or "statement". Defaults to "transaction".
+	PoolMode string
+	// ServerResetQuery is run on a server connection before it goes back
+	// to the pool, to clear the session state left by the client, like
+	// settings, temp tables, advisory locks and listened channels.
+	// By default, "DISCARD ALL" is run on the connections of session mode
+	// clients, and nothing on the ones of transaction and statement mode
+	// clients, so that their settings and prepared statements are reused.
+	// A query set here is run for all modes. "RESET ALL" only resets the
+	// settings, and "none" returns the connection as it is.
+	ServerResetQuery string
+	// MaxPreparedStatements is the number of statements kept prepared on
+	// a server connection. The least recently used ones are closed to make
+	// room for new ones. Defaults to 100.
+	MaxPreparedStatements int
+
+	// SSLMode is the sslmode used for connections to the destination.
+	// One of disable, require, verify-ca or verify-full. Defaults to disable.
+	// The SSL settings can be overridden per destination, and per tenant.
+	SSLMode string
+	// SSLRootCert is the CA bundle used to verify the destination, e.g. the RDS CA.
+	SSLRootCert string
+	// SSLCert and SSLKey are an optional client certificate presented to the destination.
+	SSLCert string
+	SSLKey  string
+}
+
+// PoolSettingsFor returns the pool settings to be used for the given destination.
+// An override can be keyed either by "host/db", or by the host alone.
+// Only the settings which are set (non-zero) in an override take effect,
+// the rest fall back to the global PoolSettings.
+func (c Config) PoolSettingsFor(host, db string) PoolSettings {
+	ps := c.PoolSettings
+	override, ok := c.OverrideSettings[host+"/"+db]
+	if !ok {
+		override, ok = c.OverrideSettings[host]
+	}
+	if !ok {
+		return ps
+	}
+
+	if override.MaxIdle != 0 {
+		ps.MaxIdle = override.MaxIdle
+	}
+	if override.MaxOpen != 0 {
+		ps.MaxOpen = override.MaxOpen
+	}
+	if override.MaxLifetimeSecs != 0 {
+		ps.MaxLifetimeSecs = override.MaxLifetimeSecs
+	}
+	if override.MaxIdletimeSecs != 0 {
+		ps.MaxIdletimeSecs = override.MaxIdletimeSecs
+	}
+	if override.ConnCreateTimeoutSecs != 0 {
+		ps.ConnCreateTimeoutSecs = override.ConnCreateTimeoutSecs
+	}
+	if override.ConnCloseTimeoutSecs != 0 {
+		ps.ConnCloseTimeoutSecs = override.ConnCloseTimeoutSecs
+	}
+	if override.SchemaExecTimeoutSecs != 0 {
+		ps.SchemaExecTimeoutSecs = override.SchemaExecTimeoutSecs
+	}
+	if override.QueryWaitTimeoutSecs != 0 {
+		ps.QueryWaitTimeoutSecs = override.QueryWaitTimeoutSecs
+	}
+	if override.MaxWaitQueue != 0 {
+		ps.MaxWaitQueue = override.MaxWaitQueue
+	}
+	if override.PoolMode != "" {
+		ps.PoolMode = override.PoolMode
+	}
+	if override.ServerResetQuery != "" {
+		ps.ServerResetQuery = override.ServerResetQuery
+	}
+	if override.MaxPreparedStatements != 0 {
+		ps.MaxPreparedStatements = override.MaxPreparedStatements
+	}
+	if override.SSLMode != "" {
+		ps.SSLMode = override.SSLMode
+	}
+	if override.SSLRootCert != "" {
+		ps.SSLRootCert = override.SSLRootCert
+	}
+	if override.SSLCert != "" {
+		ps.SSLCert = override.SSLCert
+	}
+	if override.SSLKey != "" {
+		ps.SSLKey = override.SSLKey
+	}
+	return ps
+}
+
+// TenantSettings are the settings of a single tenant. They take
+// precedence over the pool settings of its destination.
+type TenantSettings struct {
+	PoolMode string
+	// SSLMode, SSLRootCert, SSLCert and SSLKey override the SSL settings
+	// of the destination for this tenant. A tenant which sets any of them
+	// gets a pool of its own, since it cannot share the server connections
+	// of the other tenants of its destination.
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+}
+
+// hasSSL reports whether the tenant overrides any of the SSL settings.
+func (ts TenantSettings) hasSSL() bool {
+	return ts.SSLMode != "" || ts.SSLRootCert != "" || ts.SSLCert != "" || ts.SSLKey != ""
+}
+
+// PoolSettingsForTenant returns the pool settings to be used for a tenant,
+// identified by its source database and schema, which connects to the given
+// destination. ownPool is true if the tenant overrides the SSL settings of
+// the destination, and so needs a pool of its own.
+func (c Config) PoolSettingsForTenant(host, db, sourceDB, sourceSchema string) (ps PoolSettings, ownPool bool) {
+	ps = c.PoolSettingsFor(host, db)
+	ts, ok := c.TenantSettings[sourceDB+"/"+sourceSchema]
+	if !ok || !ts.hasSSL() {
+		return ps, false
+	}
+
+	if ts.SSLMode != "" {
+		ps.SSLMode = ts.SSLMode
+	}
+	if ts.SSLRootCert != "" {
+		ps.SSLRootCert = ts.SSLRootCert
+	}
+	if ts.SSLCert != "" {
+		ps.SSLCert = ts.SSLCert
+	}
+	if ts.SSLKey != "" {
+		ps.SSLKey = ts.SSLKey
+	}
+	return ps, true
+}
+
+// PoolModeFor returns the pool mode of a tenant, identified by its source
+// database and schema, which connects to the given destination.
+func (c Config) PoolModeFor(host, db, sourceDB, sourceSchema string) string {
+	if ts, ok := c.TenantSettings[sourceDB+"/"+sourceSchema]; ok && ts.PoolMode != "" {
+		return ts.PoolMode
+	}
+	return c.PoolSettingsFor(host, db).PoolMode
 }
 
 type AuthDBSettings struct {
+	// Store selects where the credentials are looked up from.
+	// One of "postgres", "file" or "webhook". Defaults to "postgres".
+	Store                string
 	AuthDBDSN            string
 	AuthQueryTimeoutSecs int
+	// AuthFile is the JSON file read by the file store.
+	AuthFile string
+	// WebhookURL is the endpoint queried by the webhook store,
+	// and WebhookToken is sent to it as a bearer token, if set.
+	WebhookURL   string
+	WebhookToken string
+
+	// CacheTTLSecs is how long looked up credentials, and passwords
+	// verified against them, are cached. Zero disables the cache.
+	CacheTTLSecs int
+	// NegativeCacheTTLSecs is how long unknown tenants are cached.
+	NegativeCacheTTLSecs int
+	// CacheMaxSize is the maximum number of cached entries. Defaults to 10000.
+	CacheMaxSize int
 }
 
 // Parse reads the config file and returns a new *Config,
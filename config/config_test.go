@@ -0,0 +1,69 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/carlmjohnson/be"
+)
+
+func TestPoolSettingsFor(t *testing.T) {
+	cfg := Config{
+		PoolSettings: PoolSettings{
+			MaxIdle: 3,
+			MaxOpen: 5,
+			SSLMode: "require",
+		},
+		OverrideSettings: map[string]PoolSettings{
+			"big.rds":        {MaxOpen: 50},
+			"big.rds/tenant": {MaxOpen: 100, MaxIdle: 20},
+		},
+	}
+
+	ps := cfg.PoolSettingsFor("big.rds", "tenant")
+	be.Equal(t, 100, ps.MaxOpen)
+	be.Equal(t, 20, ps.MaxIdle)
+	be.Equal(t, "require", ps.SSLMode)
+
+	ps = cfg.PoolSettingsFor("big.rds", "other")
+	be.Equal(t, 50, ps.MaxOpen)
+	be.Equal(t, 3, ps.MaxIdle)
+
+	ps = cfg.PoolSettingsFor("small.rds", "tenant")
+	be.Equal(t, cfg.PoolSettings, ps)
+}
+
+func TestPoolModeFor(t *testing.T) {
+	cfg := Config{
+		PoolSettings: PoolSettings{PoolMode: "transaction"},
+		OverrideSettings: map[string]PoolSettings{
+			"big.rds/jobs": {PoolMode: "statement"},
+		},
+		TenantSettings: map[string]TenantSettings{
+			"mattermost/migrations": {PoolMode: "session"},
+		},
+	}
+
+	be.Equal(t, "transaction", cfg.PoolModeFor("small.rds", "tenant", "mattermost", "tenant1"))
+	be.Equal(t, "statement", cfg.PoolModeFor("big.rds", "jobs", "mattermost", "tenant1"))
+	be.Equal(t, "session", cfg.PoolModeFor("big.rds", "jobs", "mattermost", "migrations"))
+}
+
+func TestPoolSettingsForTenant(t *testing.T) {
+	cfg := Config{
+		PoolSettings: PoolSettings{MaxOpen: 5, SSLMode: "require"},
+		TenantSettings: map[string]TenantSettings{
+			"mattermost/migrations": {PoolMode: "session"},
+			"mattermost/secure":     {SSLMode: "verify-full", SSLRootCert: "/etc/rds-ca.pem"},
+		},
+	}
+
+	ps, ownPool := cfg.PoolSettingsForTenant("big.rds", "tenant", "mattermost", "migrations")
+	be.False(t, ownPool)
+	be.Equal(t, cfg.PoolSettings, ps)
+
+	ps, ownPool = cfg.PoolSettingsForTenant("big.rds", "tenant", "mattermost", "secure")
+	be.True(t, ownPool)
+	be.Equal(t, 5, ps.MaxOpen)
+	be.Equal(t, "verify-full", ps.SSLMode)
+	be.Equal(t, "/etc/rds-ca.pem", ps.SSLRootCert)
+}
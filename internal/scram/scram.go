@@ -0,0 +1,303 @@
+// Package scram implements the server side of SCRAM-SHA-256 authentication
+// (RFC 5802, RFC 7677) as used by PostgreSQL, including the
+// tls-server-end-point channel binding (RFC 5929).
+package scram
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// SHA256 is the mechanism name without channel binding.
+	SHA256 = "SCRAM-SHA-256"
+	// SHA256Plus is the mechanism name with channel binding.
+	SHA256Plus = "SCRAM-SHA-256-PLUS"
+
+	// DefaultIterations is the iteration count used by PostgreSQL.
+	DefaultIterations = 4096
+
+	verifierPrefix = SHA256 + "$"
+	saltLen        = 16
+	nonceLen       = 18
+	cbType         = "tls-server-end-point"
+)
+
+var (
+	ErrInvalidVerifier = errors.New("invalid SCRAM verifier")
+	ErrInvalidMessage  = errors.New("malformed SCRAM message")
+	ErrAuthFailed      = errors.New("SCRAM authentication failed")
+)
+
+// Verifier is a stored SCRAM-SHA-256 credential. Its string form
+// is the same as the one PostgreSQL stores in pg_authid:
+//
+//	SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+type Verifier struct {
+	Iterations int
+	Salt       []byte
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// IsVerifier reports whether s looks like a SCRAM-SHA-256 verifier,
+// as opposed to some other kind of stored password hash.
+func IsVerifier(s string) bool {
+	return strings.HasPrefix(s, verifierPrefix)
+}
+
+// NewVerifier derives a verifier for the given password
+// with a random salt.
+func NewVerifier(password string, iterations int) (Verifier, error) {
+	if iterations <= 0 {
+		iterations = DefaultIterations
+	}
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return Verifier{}, fmt.Errorf("error generating salt: %w", err)
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := computeHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	return Verifier{
+		Iterations: iterations,
+		Salt:       salt,
+		StoredKey:  storedKey[:],
+		ServerKey:  computeHMAC(saltedPassword, []byte("Server Key")),
+	}, nil
+}
+
+// ParseVerifier parses the string form of a verifier.
+func ParseVerifier(s string) (Verifier, error) {
+	if !IsVerifier(s) {
+		return Verifier{}, ErrInvalidVerifier
+	}
+	parts := strings.Split(strings.TrimPrefix(s, verifierPrefix), "$")
+	if len(parts) != 2 {
+		return Verifier{}, ErrInvalidVerifier
+	}
+	iterSalt := strings.Split(parts[0], ":")
+	keys := strings.Split(parts[1], ":")
+	if len(iterSalt) != 2 || len(keys) != 2 {
+		return Verifier{}, ErrInvalidVerifier
+	}
+
+	var (
+		v   Verifier
+		err error
+	)
+	if v.Iterations, err = strconv.Atoi(iterSalt[0]); err != nil || v.Iterations <= 0 {
+		return Verifier{}, ErrInvalidVerifier
+	}
+	if v.Salt, err = base64.StdEncoding.DecodeString(iterSalt[1]); err != nil {
+		return Verifier{}, ErrInvalidVerifier
+	}
+	if v.StoredKey, err = base64.StdEncoding.DecodeString(keys[0]); err != nil || len(v.StoredKey) != sha256.Size {
+		return Verifier{}, ErrInvalidVerifier
+	}
+	if v.ServerKey, err = base64.StdEncoding.DecodeString(keys[1]); err != nil || len(v.ServerKey) != sha256.Size {
+		return Verifier{}, ErrInvalidVerifier
+	}
+	return v, nil
+}
+
+func (v Verifier) String() string {
+	return fmt.Sprintf("%s%d:%s$%s:%s", verifierPrefix, v.Iterations,
+		base64.StdEncoding.EncodeToString(v.Salt),
+		base64.StdEncoding.EncodeToString(v.StoredKey),
+		base64.StdEncoding.EncodeToString(v.ServerKey))
+}
+
+// ServerConversation holds the state of a single SCRAM exchange.
+// A conversation is driven by calling ServerFirst with the client-first-message,
+// followed by ServerFinal with the client-final-message.
+type ServerConversation struct {
+	verifier Verifier
+	// cbData is the tls-server-end-point channel binding data,
+	// or nil if the connection is not over TLS.
+	cbData []byte
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+}
+
+// NewServerConversation starts a conversation against the stored verifier.
+// serverCert is the DER encoded certificate that the server presented to
+// the client, and is nil if the connection is not over TLS.
+func NewServerConversation(v Verifier, serverCert []byte) (*ServerConversation, error) {
+	sc := &ServerConversation{verifier: v}
+	if serverCert != nil {
+		cbData, err := tlsServerEndPoint(serverCert)
+		if err != nil {
+			return nil, err
+		}
+		sc.cbData = cbData
+	}
+	return sc, nil
+}
+
+// Mechanisms returns the mechanisms that can be advertised to the client.
+func (sc *ServerConversation) Mechanisms() []string {
+	if sc.cbData != nil {
+		return []string{SHA256Plus, SHA256}
+	}
+	return []string{SHA256}
+}
+
+// ServerFirst validates the client-first-message sent with the chosen mechanism
+// and returns the server-first-message.
+func (sc *ServerConversation) ServerFirst(mechanism string, clientFirst []byte) ([]byte, error) {
+	// gs2-header is "<cbind-flag>,<authzid>,"
+	msg := string(clientFirst)
+	flagEnd := strings.IndexByte(msg, ',')
+	if flagEnd < 0 {
+		return nil, ErrInvalidMessage
+	}
+	authzEnd := strings.IndexByte(msg[flagEnd+1:], ',')
+	if authzEnd < 0 {
+		return nil, ErrInvalidMessage
+	}
+	headerEnd := flagEnd + 1 + authzEnd + 1
+	cbFlag := msg[:flagEnd]
+	sc.gs2Header = msg[:headerEnd]
+	sc.clientFirstBare = msg[headerEnd:]
+
+	switch mechanism {
+	case SHA256Plus:
+		if sc.cbData == nil {
+			return nil, errors.New("channel binding requested on a non-TLS connection")
+		}
+		if cbFlag != "p="+cbType {
+			return nil, fmt.Errorf("unsupported channel binding type %q", cbFlag)
+		}
+	case SHA256:
+		switch cbFlag {
+		case "n":
+		case "y":
+			// The client supports channel binding but thinks we don't.
+			// If we had offered it, this is a downgrade attempt.
+			if sc.cbData != nil {
+				return nil, errors.New("channel binding was offered but the client did not use it")
+			}
+		default:
+			return nil, fmt.Errorf("channel binding flag %q is not allowed with %s", cbFlag, SHA256)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported SASL mechanism %q", mechanism)
+	}
+
+	// client-first-message-bare is "n=<user>,r=<nonce>[,extensions]".
+	// The user name is ignored, PostgreSQL uses the one from the startup message.
+	attrs := strings.Split(sc.clientFirstBare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, ErrInvalidMessage
+	}
+	clientNonce := strings.TrimPrefix(attrs[1], "r=")
+	if clientNonce == "" {
+		return nil, ErrInvalidMessage
+	}
+
+	serverNonce := make([]byte, nonceLen)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	sc.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(serverNonce)
+	sc.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", sc.nonce,
+		base64.StdEncoding.EncodeToString(sc.verifier.Salt), sc.verifier.Iterations)
+
+	return []byte(sc.serverFirst), nil
+}
+
+// ServerFinal verifies the client proof from the client-final-message and
+// returns the server-final-message. ErrAuthFailed is returned if the
+// proof does not match.
+func (sc *ServerConversation) ServerFinal(clientFinal []byte) ([]byte, error) {
+	// client-final-message is "c=<binding>,r=<nonce>[,extensions],p=<proof>"
+	msg := string(clientFinal)
+	proofIdx := strings.LastIndex(msg, ",p=")
+	if proofIdx < 0 {
+		return nil, ErrInvalidMessage
+	}
+	withoutProof := msg[:proofIdx]
+	proof, err := base64.StdEncoding.DecodeString(msg[proofIdx+len(",p="):])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, ErrInvalidMessage
+	}
+
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, ErrInvalidMessage
+	}
+	binding, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(attrs[0], "c="))
+	if err != nil {
+		return nil, ErrInvalidMessage
+	}
+	expectedBinding := []byte(sc.gs2Header)
+	if strings.HasPrefix(sc.gs2Header, "p=") {
+		expectedBinding = append(expectedBinding, sc.cbData...)
+	}
+	if !bytes.Equal(binding, expectedBinding) {
+		return nil, errors.New("channel binding mismatch")
+	}
+	if strings.TrimPrefix(attrs[1], "r=") != sc.nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	authMessage := []byte(sc.clientFirstBare + "," + sc.serverFirst + "," + withoutProof)
+	clientSignature := computeHMAC(sc.verifier.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], sc.verifier.StoredKey) != 1 {
+		return nil, ErrAuthFailed
+	}
+
+	serverSignature := computeHMAC(sc.verifier.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// tlsServerEndPoint computes the tls-server-end-point channel binding data,
+// which is the hash of the server certificate. The hash is the one used in
+// the certificate signature, with MD5 and SHA-1 upgraded to SHA-256.
+func tlsServerEndPoint(der []byte) ([]byte, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing server certificate: %w", err)
+	}
+
+	var h hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		h = sha512.New()
+	default:
+		h = sha256.New()
+	}
+	h.Write(der)
+	return h.Sum(nil), nil
+}
+
+func computeHMAC(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
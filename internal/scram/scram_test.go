@@ -0,0 +1,136 @@
+package scram
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carlmjohnson/be"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestVerifierRoundTrip(t *testing.T) {
+	v, err := NewVerifier("pencil", 0)
+	be.NilErr(t, err)
+	be.Equal(t, DefaultIterations, v.Iterations)
+	be.True(t, IsVerifier(v.String()))
+
+	parsed, err := ParseVerifier(v.String())
+	be.NilErr(t, err)
+	be.Equal(t, v.String(), parsed.String())
+
+	_, err = ParseVerifier("SCRAM-SHA-256$4096:c2FsdA==")
+	be.True(t, errors.Is(err, ErrInvalidVerifier))
+	be.False(t, IsVerifier("c29tZXNjcnlwdGhhc2g="))
+}
+
+func TestConversation(t *testing.T) {
+	v, err := NewVerifier("pencil", 4096)
+	be.NilErr(t, err)
+
+	t.Run("success", func(t *testing.T) {
+		conv, err := NewServerConversation(v, nil)
+		be.NilErr(t, err)
+		be.AllEqual(t, []string{SHA256}, conv.Mechanisms())
+		be.NilErr(t, runClient(t, conv, SHA256, "n,,", nil, "pencil"))
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		conv, err := NewServerConversation(v, nil)
+		be.NilErr(t, err)
+		be.True(t, errors.Is(runClient(t, conv, SHA256, "n,,", nil, "pen"), ErrAuthFailed))
+	})
+
+	t.Run("channel binding", func(t *testing.T) {
+		cert := genCert(t)
+		conv, err := NewServerConversation(v, cert)
+		be.NilErr(t, err)
+		be.AllEqual(t, []string{SHA256Plus, SHA256}, conv.Mechanisms())
+		cbData := sha256.Sum256(cert)
+		be.NilErr(t, runClient(t, conv, SHA256Plus, "p=tls-server-end-point,,", cbData[:], "pencil"))
+	})
+
+	t.Run("channel binding mismatch", func(t *testing.T) {
+		conv, err := NewServerConversation(v, genCert(t))
+		be.NilErr(t, err)
+		err = runClient(t, conv, SHA256Plus, "p=tls-server-end-point,,", []byte("bogus"), "pencil")
+		be.Nonzero(t, err)
+	})
+
+	t.Run("downgrade", func(t *testing.T) {
+		conv, err := NewServerConversation(v, genCert(t))
+		be.NilErr(t, err)
+		_, err = conv.ServerFirst(SHA256, []byte("y,,n=,r=abcdef"))
+		be.Nonzero(t, err)
+	})
+}
+
+// runClient plays the client side of the exchange.
+func runClient(t *testing.T, conv *ServerConversation, mech, gs2Header string, cbData []byte, password string) error {
+	t.Helper()
+	clientFirstBare := "n=,r=rOprNGfwEbeRWgbNEkqO"
+	serverFirst, err := conv.ServerFirst(mech, []byte(gs2Header+clientFirstBare))
+	if err != nil {
+		return err
+	}
+
+	var nonce, salt string
+	var iters int
+	for _, attr := range strings.Split(string(serverFirst), ",") {
+		switch attr[:2] {
+		case "r=":
+			nonce = attr[2:]
+		case "s=":
+			salt = attr[2:]
+		case "i=":
+			iters, err = strconv.Atoi(attr[2:])
+			be.NilErr(t, err)
+		}
+	}
+	rawSalt, err := base64.StdEncoding.DecodeString(salt)
+	be.NilErr(t, err)
+
+	saltedPassword := pbkdf2.Key([]byte(password), rawSalt, iters, sha256.Size, sha256.New)
+	clientKey := computeHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(append([]byte(gs2Header), cbData...)) + ",r=" + nonce
+	authMessage := clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	clientSignature := computeHMAC(storedKey[:], []byte(authMessage))
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	serverFinal, err := conv.ServerFinal([]byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	serverKey := computeHMAC(saltedPassword, []byte("Server Key"))
+	be.Equal(t, "v="+base64.StdEncoding.EncodeToString(computeHMAC(serverKey, []byte(authMessage))), string(serverFinal))
+	return nil
+}
+
+func genCert(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	be.NilErr(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "perseus"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	be.NilErr(t, err)
+	return der
+}
@@ -0,0 +1,508 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+const (
+	defaultAdminDB = "perseus"
+	textOID        = 25
+)
+
+// adminResult is the result of an admin command, sent to
+// the client as a set of text columns.
+type adminResult struct {
+	columns []string
+	rows    [][]string
+	// tag is the command tag. Defaults to SHOW.
+	tag string
+}
+
+// adminCommand runs an admin command. arg is the optional
+// argument which follows the command, or empty.
+type adminCommand func(s *Server, arg string) (*adminResult, error)
+
+// adminCommands maps the upper cased name of a command to its handler.
+var adminCommands = map[string]adminCommand{
+	"SHOW POOLS":   noArg((*Server).showPools),
+	"SHOW CLIENTS": noArg((*Server).showClients),
+	"SHOW SERVERS": noArg((*Server).showServers),
+	"SHOW STATS":   noArg((*Server).showStats),
+	"SHOW CONFIG":  noArg((*Server).showConfig),
+	"PAUSE":        (*Server).pausePools,
+	"RESUME":       (*Server).resumePools,
+	"RECONNECT":    (*Server).reconnectPools,
+	"KILL":         (*Server).killClients,
+	"RELOAD":       noArg((*Server).reloadConfig),
+}
+
+// noArg adapts a handler for a command which takes no argument.
+func noArg(fn func(s *Server) (*adminResult, error)) adminCommand {
+	return func(s *Server, arg string) (*adminResult, error) {
+		if arg != "" {
+			return nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+		return fn(s)
+	}
+}
+
+// secretSettings are the config keys whose values are masked in SHOW CONFIG.
+// The DSN of the auth DB is masked entirely, since its password can be
+// anywhere in it.
+var secretSettings = map[string]bool{
+	"AccessKeyId":     true,
+	"SecretAccessKey": true,
+	"AuthDBDSN":       true,
+	"WebhookToken":    true,
+	"PasswordHashed":  true,
+}
+
+// isAdminDB reports whether the client connected to the admin console.
+func (s *Server) isAdminDB(database string) bool {
+	settings := s.cfg.Load().AdminSettings
+	if settings.User == "" {
+		return false
+	}
+	adminDB := settings.Database
+	if adminDB == "" {
+		adminDB = defaultAdminDB
+	}
+	return database == adminDB
+}
+
+// handleAdminConn authenticates the admin and runs the command loop of the admin console.
+// Only the simple query protocol is supported.
+func (s *Server) handleAdminConn(c net.Conn, handle *pgproto3.Backend, params *startupParams) error {
+	settings := s.cfg.Load().AdminSettings
+	ipKey := "ip:" + remoteIP(c)
+	if err := s.limiter.check(ipKey); err != nil {
+		sendAndFlush(handle, fatalf(errorCode(err, codeInvalidAuthorization), "%v", err))
+		return err
+	}
+
+	if params.username != settings.User {
+		s.limiter.fail(ipKey)
+		s.logger.Warn("Authentication failed: user is not an admin", "user", params.username, "client_addr", c.RemoteAddr().String())
+		return s.rejectUnknownUser(handle, params)
+	}
+
+	row := AuthRow{
+		source_db:          params.database,
+		source_user:        params.username,
+		source_pass_hashed: settings.PasswordHashed,
+	}
+	if err := s.authenticate(handle, params, row); err != nil {
+		if errors.Is(err, ErrPasswordMismatch) {
+			s.limiter.fail(ipKey)
+		}
+		return err
+	}
+	s.limiter.succeed(ipKey)
+	s.logger.Info("Admin connected", "user", params.username, "client_addr", c.RemoteAddr().String())
+
+	handle.Send(&pgproto3.AuthenticationOk{})
+	for _, ps := range []pgproto3.ParameterStatus{
+		{Name: "server_version", Value: "perseus"},
+		{Name: "server_encoding", Value: "UTF8"},
+		{Name: "client_encoding", Value: "UTF8"},
+		{Name: "DateStyle", Value: "ISO"},
+		{Name: "integer_datetimes", Value: "on"},
+		{Name: "standard_conforming_strings", Value: "on"},
+	} {
+		ps := ps
+		handle.Send(&ps)
+	}
+	handle.Send(&pgproto3.ReadyForQuery{TxStatus: StatusIdle})
+	if err := handle.Flush(); err != nil {
+		return fmt.Errorf("error while flushing authOK: %w", err)
+	}
+
+	for {
+		feMsg, err := handle.Receive()
+		if err != nil {
+			return fmt.Errorf("error while receiving from admin conn: %w", err)
+		}
+
+		switch typedMsg := feMsg.(type) {
+		case *pgproto3.Query:
+			if err := s.runAdminQuery(handle, typedMsg.String); err != nil {
+				return err
+			}
+		case *pgproto3.Terminate:
+			return nil
+		default:
+			err := fatalf(codeFeatureNotSupported, "the admin console only supports the simple query protocol")
+			sendAndFlush(handle, err)
+			return err
+		}
+	}
+}
+
+func (s *Server) runAdminQuery(handle *pgproto3.Backend, query string) error {
+	var (
+		res *adminResult
+		err error
+	)
+	if fn, arg, ok := parseAdminCommand(query); ok {
+		res, err = fn(s, arg)
+	} else if strings.TrimSpace(query) == "" {
+		handle.Send(&pgproto3.EmptyQueryResponse{})
+	} else {
+		err = fmt.Errorf("unsupported admin command: %s", query)
+	}
+
+	if err != nil {
+		handle.Send(errorf(codeSyntaxError, "%v", err).response())
+	} else if res != nil {
+		sendAdminResult(handle, res)
+	}
+	handle.Send(&pgproto3.ReadyForQuery{TxStatus: StatusIdle})
+	if err := handle.Flush(); err != nil {
+		return fmt.Errorf("error while flushing to admin conn: %w", err)
+	}
+	return nil
+}
+
+// parseAdminCommand looks up the command in the query, which is either
+// a single word or SHOW followed by a word. The argument is whatever
+// follows the command, with its case preserved.
+func parseAdminCommand(query string) (adminCommand, string, bool) {
+	fields := strings.Fields(strings.TrimRight(strings.TrimSpace(query), ";"))
+	if len(fields) == 0 {
+		return nil, "", false
+	}
+	n := 1
+	if strings.EqualFold(fields[0], "SHOW") && len(fields) > 1 {
+		n = 2
+	}
+	fn, ok := adminCommands[strings.ToUpper(strings.Join(fields[:n], " "))]
+	return fn, strings.Join(fields[n:], " "), ok
+}
+
+func sendAdminResult(handle *pgproto3.Backend, res *adminResult) {
+	if len(res.columns) > 0 {
+		fields := make([]pgproto3.FieldDescription, len(res.columns))
+		for i, col := range res.columns {
+			fields[i] = pgproto3.FieldDescription{
+				Name:         []byte(col),
+				DataTypeOID:  textOID,
+				DataTypeSize: -1,
+				TypeModifier: -1,
+			}
+		}
+		handle.Send(&pgproto3.RowDescription{Fields: fields})
+
+		for _, row := range res.rows {
+			values := make([][]byte, len(row))
+			for i, v := range row {
+				values[i] = []byte(v)
+			}
+			handle.Send(&pgproto3.DataRow{Values: values})
+		}
+	}
+
+	tag := res.tag
+	if tag == "" {
+		tag = "SHOW"
+	}
+	handle.Send(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+}
+
+type poolEntry struct {
+	key  poolKey
+	pool *Pool
+}
+
+// sortedPools returns the pools ordered by destination.
+func (s *Server) sortedPools() []poolEntry {
+	pools := s.poolMgr.snapshot()
+	entries := make([]poolEntry, 0, len(pools))
+	for key, p := range pools {
+		entries = append(entries, poolEntry{key: key, pool: p})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].key.host != entries[j].key.host {
+			return entries[i].key.host < entries[j].key.host
+		}
+		if entries[i].key.db != entries[j].key.db {
+			return entries[i].key.db < entries[j].key.db
+		}
+		return entries[i].key.tenant < entries[j].key.tenant
+	})
+	return entries
+}
+
+// clientConns returns a snapshot of the client connections,
+// along with their key data.
+func (s *Server) clientConns() map[pgproto3.BackendKeyData]*ClientConn {
+	s.keyDataMut.Lock()
+	defer s.keyDataMut.Unlock()
+	clients := make(map[pgproto3.BackendKeyData]*ClientConn, len(s.keyDataMap))
+	for keyData, cc := range s.keyDataMap {
+		clients[keyData] = cc
+	}
+	return clients
+}
+
+func (s *Server) showPools() (*adminResult, error) {
+	res := &adminResult{columns: []string{"host", "database", "tenant", "max_open", "open", "in_use", "idle", "waiting", "paused"}}
+	for _, entry := range s.sortedPools() {
+		stats := entry.pool.Stats()
+		res.rows = append(res.rows, []string{
+			entry.key.host,
+			entry.key.db,
+			entry.key.tenant,
+			strconv.Itoa(stats.MaxOpenConnections),
+			strconv.Itoa(stats.OpenConnections),
+			strconv.Itoa(stats.InUse),
+			strconv.Itoa(stats.Idle),
+			strconv.Itoa(stats.Waiting),
+			strconv.FormatBool(stats.Paused),
+		})
+	}
+	return res, nil
+}
+
+func (s *Server) showStats() (*adminResult, error) {
+	res := &adminResult{columns: []string{"host", "database", "tenant", "wait_count", "wait_duration_ms",
+		"wait_timeouts", "wait_rejected", "max_idle_closed", "max_idle_time_closed", "max_lifetime_closed"}}
+	for _, entry := range s.sortedPools() {
+		stats := entry.pool.Stats()
+		res.rows = append(res.rows, []string{
+			entry.key.host,
+			entry.key.db,
+			entry.key.tenant,
+			strconv.FormatInt(stats.WaitCount, 10),
+			strconv.FormatInt(stats.WaitDuration.Milliseconds(), 10),
+			strconv.FormatInt(stats.WaitTimeoutCount, 10),
+			strconv.FormatInt(stats.WaitRejectedCount, 10),
+			strconv.FormatInt(stats.MaxIdleClosed, 10),
+			strconv.FormatInt(stats.MaxIdleTimeClosed, 10),
+			strconv.FormatInt(stats.MaxLifetimeClosed, 10),
+		})
+	}
+	return res, nil
+}
+
+func (s *Server) showClients() (*adminResult, error) {
+	res := &adminResult{columns: []string{"process_id", "user", "database", "schema", "addr",
+		"connected_at", "state", "pool_mode", "dest_host", "dest_database", "server_pid"}}
+
+	dests := make(map[*Pool]poolKey)
+	for _, entry := range s.sortedPools() {
+		dests[entry.pool] = entry.key
+	}
+
+	clients := s.clientConns()
+	keyDatas := make([]pgproto3.BackendKeyData, 0, len(clients))
+	for keyData := range clients {
+		keyDatas = append(keyDatas, keyData)
+	}
+	sort.Slice(keyDatas, func(i, j int) bool {
+		return clients[keyDatas[i]].connectedAt.Before(clients[keyDatas[j]].connectedAt)
+	})
+
+	for _, keyData := range keyDatas {
+		cc := clients[keyData]
+		state, serverPID := "idle", ""
+		cc.mut.Lock()
+		if cc.serverConn != nil {
+			state = "active"
+			if info, ok := cc.serverConn.info(); ok {
+				serverPID = strconv.FormatUint(uint64(info.pid), 10)
+			}
+		}
+		cc.mut.Unlock()
+
+		dest := dests[cc.pool]
+		res.rows = append(res.rows, []string{
+			strconv.FormatUint(uint64(keyData.ProcessID), 10),
+			cc.user,
+			cc.database,
+			cc.schema,
+			cc.conn.RemoteAddr().String(),
+			cc.connectedAt.Format(time.RFC3339),
+			state,
+			cc.mode,
+			dest.host,
+			dest.db,
+			serverPID,
+		})
+	}
+	return res, nil
+}
+
+func (s *Server) showServers() (*adminResult, error) {
+	res := &adminResult{columns: []string{"pid", "host", "database", "state", "local_addr",
+		"created_at", "client_process_id"}}
+
+	// Servers in use are only known through the clients using them. Their
+	// details are read while the client holds them, since the client may
+	// close them once it lets go of its lock.
+	type activeServer struct {
+		info     serverConnInfo
+		clientID uint32
+	}
+	active := make(map[*Pool][]activeServer)
+	for keyData, cc := range s.clientConns() {
+		cc.mut.Lock()
+		if cc.serverConn != nil {
+			if info, ok := cc.serverConn.info(); ok {
+				active[cc.pool] = append(active[cc.pool], activeServer{info: info, clientID: keyData.ProcessID})
+			}
+		}
+		cc.mut.Unlock()
+	}
+
+	serverRow := func(key poolKey, info serverConnInfo, state, clientID string) []string {
+		return []string{
+			strconv.FormatUint(uint64(info.pid), 10),
+			key.host,
+			key.db,
+			state,
+			info.localAddr,
+			info.createdAt.Format(time.RFC3339),
+			clientID,
+		}
+	}
+
+	for _, entry := range s.sortedPools() {
+		for _, as := range active[entry.pool] {
+			res.rows = append(res.rows, serverRow(entry.key, as.info, "active", strconv.FormatUint(uint64(as.clientID), 10)))
+		}
+		for _, info := range entry.pool.idleConnInfos() {
+			res.rows = append(res.rows, serverRow(entry.key, info, "idle", ""))
+		}
+	}
+	return res, nil
+}
+
+// matchPools returns the pools matching the argument of a pool command.
+// The argument is either "host/db", or a host to match all its pools,
+// the same as the keys of OverrideSettings. All pools match an empty argument.
+func (s *Server) matchPools(arg string) ([]poolEntry, error) {
+	host, db, hasDB := strings.Cut(arg, "/")
+	var matched []poolEntry
+	for _, entry := range s.sortedPools() {
+		if arg == "" || (entry.key.host == host && (!hasDB || entry.key.db == db)) {
+			matched = append(matched, entry)
+		}
+	}
+	if len(matched) == 0 && arg != "" {
+		return nil, fmt.Errorf("no pool matches %q", arg)
+	}
+	return matched, nil
+}
+
+func (s *Server) pausePools(arg string) (*adminResult, error) {
+	entries, err := s.matchPools(arg)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		entry.pool.Pause()
+		s.logger.Info("Admin paused the pool", "dest_host", entry.key.host, "dest_db", entry.key.db)
+	}
+	return &adminResult{tag: "PAUSE"}, nil
+}
+
+func (s *Server) resumePools(arg string) (*adminResult, error) {
+	entries, err := s.matchPools(arg)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		entry.pool.Resume()
+		s.logger.Info("Admin resumed the pool", "dest_host", entry.key.host, "dest_db", entry.key.db)
+	}
+	return &adminResult{tag: "RESUME"}, nil
+}
+
+func (s *Server) reconnectPools(arg string) (*adminResult, error) {
+	entries, err := s.matchPools(arg)
+	if err != nil {
+		return nil, err
+	}
+	// Make sure the next client to use the pool
+	// brings the latest destination credentials.
+	s.InvalidateCredentialCache()
+	for _, entry := range entries {
+		s.poolMgr.Reconnect(entry.key)
+		s.logger.Info("Admin reconnected the pool", "dest_host", entry.key.host, "dest_db", entry.key.db)
+	}
+	return &adminResult{tag: "RECONNECT"}, nil
+}
+
+// killClients closes the connections of all clients of a tenant,
+// identified by "source_db/source_schema".
+func (s *Server) killClients(arg string) (*adminResult, error) {
+	db, schema, ok := strings.Cut(arg, "/")
+	if !ok || db == "" || schema == "" {
+		return nil, errors.New("KILL needs a tenant in the form source_db/source_schema")
+	}
+	killed := 0
+	for _, cc := range s.clientConns() {
+		if cc.database == db && cc.schema == schema {
+			// The handler of the conn cleans up after it.
+			cc.conn.Close()
+			killed++
+		}
+	}
+	s.logger.Info("Admin killed clients", "db", db, "schema", schema, "count", killed)
+	return &adminResult{tag: "KILL " + strconv.Itoa(killed)}, nil
+}
+
+func (s *Server) reloadConfig() (*adminResult, error) {
+	if s.loadConfig == nil {
+		return nil, errors.New("reloading is not available")
+	}
+	cfg, err := s.loadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("could not parse config file: %w", err)
+	}
+	s.Reload(cfg)
+	return &adminResult{tag: "RELOAD"}, nil
+}
+
+func (s *Server) showConfig() (*adminResult, error) {
+	res := &adminResult{columns: []string{"key", "value"}}
+	flattenConfig("", reflect.ValueOf(*s.cfg.Load()), &res.rows)
+	return res, nil
+}
+
+// flattenConfig walks through the config, and appends a row for every
+// setting with its full path as the key. Secrets are masked.
+func flattenConfig(prefix string, v reflect.Value, rows *[][]string) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name := v.Type().Field(i).Name
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			flattenConfig(name, v.Field(i), rows)
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			flattenConfig(fmt.Sprintf("%s[%s]", prefix, key.String()), v.MapIndex(key), rows)
+		}
+	default:
+		value := fmt.Sprint(v.Interface())
+		field := prefix[strings.LastIndex(prefix, ".")+1:]
+		if secretSettings[field] && value != "" {
+			value = "********"
+		}
+		*rows = append(*rows, []string{prefix, value})
+	}
+}
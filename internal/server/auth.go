@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	scrypt "github.com/agnivade/easy-scrypt"
+	"github.com/agnivade/perseus/internal/scram"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// ErrPasswordMismatch is returned when the client
+// fails to prove that it knows the password.
+var ErrPasswordMismatch = errors.New("password mismatch")
+
+// authenticate verifies the client against the credentials in the auth row.
+// The mechanism is chosen per row: rows holding a SCRAM verifier use
+// SCRAM-SHA-256, and the rest receive a cleartext password which is
+// verified against the scrypt hash. This lets tenants be migrated gradually.
+func (s *Server) authenticate(handle *pgproto3.Backend, params *startupParams, row AuthRow) error {
+	if scram.IsVerifier(row.source_pass_hashed) {
+		return s.authenticateSCRAM(handle, params, row)
+	}
+	return s.authenticateCleartext(handle, params, row)
+}
+
+// dummyHash is the scrypt hash the passwords of unknown users are
+// verified against, so that rejecting them takes as long as rejecting
+// a wrong password.
+var dummyHash = sync.OnceValues(func() ([]byte, error) {
+	return scrypt.DerivePassphrase("perseus", 32)
+})
+
+// rejectUnknownUser asks a user which has no credentials for its password,
+// and rejects it the same way as a wrong one, so that the users which
+// exist cannot be told apart from the ones which do not.
+func (s *Server) rejectUnknownUser(handle *pgproto3.Backend, params *startupParams) error {
+	handle.Send(&pgproto3.AuthenticationCleartextPassword{})
+	if err := handle.Flush(); err != nil {
+		return fmt.Errorf("error while flushing authPasswd: %w", err)
+	}
+
+	pass, err := handle.Receive()
+	if err != nil {
+		return err
+	}
+	typedPass, ok := pass.(*pgproto3.PasswordMessage)
+	if !ok {
+		return errors.New("didn't receive password message")
+	}
+
+	hash, err := dummyHash()
+	if err != nil {
+		err := fatalf(codeInternalError, "error verifying password: %v", err)
+		sendAndFlush(handle, err)
+		return err
+	}
+	release, err := s.limiter.acquireVerify(time.Second * time.Duration(s.cfg.Load().AuthDBSettings.AuthQueryTimeoutSecs))
+	if err != nil {
+		sendAndFlush(handle, fatalf(errorCode(err, codeTooManyConnections), "%v", err))
+		return err
+	}
+	scrypt.VerifyPassphrase(typedPass.Password, hash)
+	release()
+	sendAndFlush(handle, passwordFailed(params))
+	return ErrCredentialsNotFound
+}
+
+// passwordFailed is the error reported for a wrong password, or an unknown user.
+func passwordFailed(params *startupParams) *pgError {
+	return fatalf(codeInvalidPassword, "password authentication failed for user %q", params.username)
+}
+
+func (s *Server) authenticateCleartext(handle *pgproto3.Backend, params *startupParams, row AuthRow) error {
+	// We send in cleartext because we hash with a better
+	// algorithm than MD5.
+	handle.Send(&pgproto3.AuthenticationCleartextPassword{})
+	if err := handle.Flush(); err != nil {
+		return fmt.Errorf("error while flushing authPasswd: %w", err)
+	}
+
+	pass, err := handle.Receive()
+	if err != nil {
+		return err
+	}
+	typedPass, ok := pass.(*pgproto3.PasswordMessage)
+	if !ok {
+		return errors.New("didn't receive password message")
+	}
+
+	if s.authCache.isVerified(row, typedPass.Password) {
+		return nil
+	}
+
+	decPass, err := base64.StdEncoding.DecodeString(row.source_pass_hashed)
+	if err != nil {
+		err := fatalf(codeInternalError, "error decoding from base64: %v", err)
+		sendAndFlush(handle, err)
+		return err
+	}
+
+	release, err := s.limiter.acquireVerify(time.Second * time.Duration(s.cfg.Load().AuthDBSettings.AuthQueryTimeoutSecs))
+	if err != nil {
+		sendAndFlush(handle, fatalf(errorCode(err, codeTooManyConnections), "%v", err))
+		return err
+	}
+	ok, err = scrypt.VerifyPassphrase(typedPass.Password, decPass)
+	release()
+	if err != nil {
+		err := fatalf(codeInternalError, "error verifying password: %v", err)
+		sendAndFlush(handle, err)
+		return err
+	}
+	if !ok {
+		sendAndFlush(handle, passwordFailed(params))
+		return ErrPasswordMismatch
+	}
+	s.authCache.markVerified(row, typedPass.Password)
+	return nil
+}
+
+func (s *Server) authenticateSCRAM(handle *pgproto3.Backend, params *startupParams, row AuthRow) error {
+	verifier, err := scram.ParseVerifier(row.source_pass_hashed)
+	if err != nil {
+		err := fatalf(codeInternalError, "error parsing SCRAM verifier: %v", err)
+		sendAndFlush(handle, err)
+		return err
+	}
+
+	conv, err := scram.NewServerConversation(verifier, params.serverCert)
+	if err != nil {
+		err := fatalf(codeInternalError, "error starting SCRAM exchange: %v", err)
+		sendAndFlush(handle, err)
+		return err
+	}
+
+	handle.Send(&pgproto3.AuthenticationSASL{AuthMechanisms: conv.Mechanisms()})
+	if err := handle.Flush(); err != nil {
+		return fmt.Errorf("error while flushing authSASL: %w", err)
+	}
+	if err := handle.SetAuthType(pgproto3.AuthTypeSASL); err != nil {
+		return err
+	}
+
+	msg, err := handle.Receive()
+	if err != nil {
+		return err
+	}
+	initial, ok := msg.(*pgproto3.SASLInitialResponse)
+	if !ok {
+		return fmt.Errorf("didn't receive SASL initial response, got %T", msg)
+	}
+
+	serverFirst, err := conv.ServerFirst(initial.AuthMechanism, initial.Data)
+	if err != nil {
+		err := fatalf(codeProtocolViolation, "error during SCRAM exchange: %v", err)
+		sendAndFlush(handle, err)
+		return err
+	}
+	handle.Send(&pgproto3.AuthenticationSASLContinue{Data: serverFirst})
+	if err := handle.Flush(); err != nil {
+		return fmt.Errorf("error while flushing authSASLContinue: %w", err)
+	}
+	if err := handle.SetAuthType(pgproto3.AuthTypeSASLContinue); err != nil {
+		return err
+	}
+
+	msg, err = handle.Receive()
+	if err != nil {
+		return err
+	}
+	resp, ok := msg.(*pgproto3.SASLResponse)
+	if !ok {
+		return fmt.Errorf("didn't receive SASL response, got %T", msg)
+	}
+
+	serverFinal, err := conv.ServerFinal(resp.Data)
+	if errors.Is(err, scram.ErrAuthFailed) {
+		sendAndFlush(handle, passwordFailed(params))
+		return ErrPasswordMismatch
+	}
+	if err != nil {
+		err := fatalf(codeProtocolViolation, "error during SCRAM exchange: %v", err)
+		sendAndFlush(handle, err)
+		return err
+	}
+
+	// AuthenticationOk is sent by the caller.
+	handle.Send(&pgproto3.AuthenticationSASLFinal{Data: serverFinal})
+	return handle.SetAuthType(pgproto3.AuthTypeOk)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/base64"
+	"log/slog"
+	"net"
+	"testing"
+
+	scrypt "github.com/agnivade/easy-scrypt"
+	"github.com/agnivade/perseus/config"
+	"github.com/carlmjohnson/be"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+func TestRejectUnknownUser(t *testing.T) {
+	s := &Server{limiter: newLoginLimiter(config.SecuritySettings{}, slog.Default())}
+	s.cfg.Store(&config.Config{AuthDBSettings: config.AuthDBSettings{AuthQueryTimeoutSecs: 5}})
+	params := &startupParams{username: "alice"}
+
+	hash, err := scrypt.DerivePassphrase("right", 32)
+	be.NilErr(t, err)
+	row := AuthRow{source_user: "alice", source_pass_hashed: base64.StdEncoding.EncodeToString(hash)}
+
+	// login returns the messages a client which sends a wrong password gets.
+	login := func(auth func(handle *pgproto3.Backend) error) []pgproto3.BackendMessage {
+		clientEnd, proxyEnd := net.Pipe()
+		defer clientEnd.Close()
+		defer proxyEnd.Close()
+		go auth(pgproto3.NewBackend(proxyEnd, proxyEnd))
+
+		client := pgproto3.NewFrontend(clientEnd, clientEnd)
+		msg, err := client.Receive()
+		be.NilErr(t, err)
+		msgs := []pgproto3.BackendMessage{msg}
+		client.Send(&pgproto3.PasswordMessage{Password: "wrong"})
+		be.NilErr(t, client.Flush())
+		msg, err = client.Receive()
+		be.NilErr(t, err)
+		return append(msgs, msg)
+	}
+
+	// A user which does not exist is asked for its password,
+	// and rejected the same way as a user which does.
+	known := login(func(handle *pgproto3.Backend) error { return s.authenticate(handle, params, row) })
+	unknown := login(func(handle *pgproto3.Backend) error { return s.rejectUnknownUser(handle, params) })
+	be.DeepEqual(t, known, unknown)
+	errResp, ok := unknown[1].(*pgproto3.ErrorResponse)
+	be.True(t, ok)
+	be.Equal(t, codeInvalidPassword, errResp.Code)
+}
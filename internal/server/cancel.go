@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// maxInstanceID is the highest instance ID. It fits
+// in the top byte of the process ID of the key data.
+const maxInstanceID = 255
+
+// cancelForwardTimeout bounds the time spent forwarding
+// a cancel request to another instance.
+const cancelForwardTimeout = 5 * time.Second
+
+// errForwardedCancel is returned for a cancel request which a peer
+// forwarded to the wrong instance. It is not forwarded again, so that
+// a misconfigured cluster cannot bounce it between instances.
+var errForwardedCancel = errors.New("cancel request forwarded by a peer for another instance")
+
+// newKeyData returns the key data identifying a new client. The ID of the
+// instance is in the top byte of the process ID, so that any instance can
+// tell which one a cancel request for the client has to go to.
+func (s *Server) newKeyData() pgproto3.BackendKeyData {
+	return pgproto3.BackendKeyData{
+		ProcessID: uint32(s.cfg.Load().ClusterSettings.InstanceID)<<24 | s.getRandUint32()&0xFFFFFF,
+		SecretKey: s.getRandUint32(),
+	}
+}
+
+// instanceID returns the ID of the instance which created the process ID.
+func instanceID(processID uint32) int {
+	return int(processID >> 24)
+}
+
+// handleCancel cancels the query of the client identified by the request.
+// Requests for the clients of another instance are forwarded to it,
+// unless they come from a peer.
+func (s *Server) handleCancel(c net.Conn, msg *pgproto3.CancelRequest) error {
+	if id := instanceID(msg.ProcessID); id != s.cfg.Load().ClusterSettings.InstanceID {
+		if s.fromPeer(c.RemoteAddr()) {
+			return fmt.Errorf("%w %d, check ClusterSettings.Peers", errForwardedCancel, id)
+		}
+		s.logger.Debug("Forwarding CancelRequest", "client_addr", c.RemoteAddr().String(), "instance_id", id)
+		return s.forwardCancel(id, msg)
+	}
+
+	s.keyDataMut.Lock()
+	toCancel := s.keyDataMap[pgproto3.BackendKeyData{
+		ProcessID: msg.ProcessID,
+		SecretKey: msg.SecretKey,
+	}]
+	s.keyDataMut.Unlock()
+
+	// A client connection should exist
+	if toCancel == nil {
+		return fmt.Errorf("connection not found with given cancel request: %v", msg)
+	}
+
+	s.logger.Debug("Handling CancelRequest", "client_addr", c.RemoteAddr().String())
+	if err := toCancel.CancelServerConn(); err != nil {
+		return fmt.Errorf("error while cancelling server conn: %w", err)
+	}
+	return nil
+}
+
+// forwardCancel sends the cancel request to the instance with the given ID,
+// and waits for it to close the conn, which it does once it is done.
+func (s *Server) forwardCancel(id int, msg *pgproto3.CancelRequest) error {
+	peers := s.cfg.Load().ClusterSettings.Peers
+	if id >= len(peers) || peers[id] == "" {
+		return fmt.Errorf("no peer with instance ID %d for cancel request", id)
+	}
+
+	conn, err := net.DialTimeout("tcp", peers[id], cancelForwardTimeout)
+	if err != nil {
+		return fmt.Errorf("error while dialing peer %s: %w", peers[id], err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(cancelForwardTimeout))
+
+	if _, err := conn.Write(msg.Encode(nil)); err != nil {
+		return fmt.Errorf("error while forwarding cancel request to %s: %w", peers[id], err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error while waiting for peer %s: %w", peers[id], err)
+	}
+	return nil
+}
+
+// resolvePeers looks up the addresses of the peers, so that fromPeer
+// does not depend on DNS. It is run on startup, and again on reload,
+// in case the addresses of the peers changed.
+func (s *Server) resolvePeers() {
+	var ips []net.IP
+	for _, peer := range s.cfg.Load().ClusterSettings.Peers {
+		if peer == "" {
+			continue
+		}
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			s.logger.Warn("Invalid peer address", "peer", peer, "err", err)
+			continue
+		}
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			s.logger.Warn("Could not resolve peer", "peer", peer, "err", err)
+			continue
+		}
+		ips = append(ips, addrs...)
+	}
+	s.peerIPs.Store(&ips)
+}
+
+// fromPeer reports whether addr is the address of one of the peers.
+func (s *Server) fromPeer(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ips := s.peerIPs.Load()
+	if ips == nil {
+		return false
+	}
+	for _, ip := range *ips {
+		if ip.Equal(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
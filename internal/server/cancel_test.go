@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/agnivade/perseus/config"
+	"github.com/carlmjohnson/be"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+func TestForwardCancel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	be.NilErr(t, err)
+	defer l.Close()
+
+	received := make(chan *pgproto3.CancelRequest, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		msg, err := pgproto3.NewBackend(c, c).ReceiveStartupMessage()
+		if err != nil {
+			return
+		}
+		received <- msg.(*pgproto3.CancelRequest)
+	}()
+
+	s := &Server{}
+	s.cfg.Store(&config.Config{ClusterSettings: config.ClusterSettings{
+		InstanceID: 0,
+		Peers:      []string{"", l.Addr().String()},
+	}})
+	other := &Server{}
+	other.cfg.Store(&config.Config{ClusterSettings: config.ClusterSettings{InstanceID: 1}})
+	keyData := other.newKeyData()
+	be.Equal(t, 1, instanceID(keyData.ProcessID))
+
+	msg := &pgproto3.CancelRequest{ProcessID: keyData.ProcessID, SecretKey: keyData.SecretKey}
+	be.NilErr(t, s.forwardCancel(instanceID(msg.ProcessID), msg))
+	got := <-received
+	be.Equal(t, keyData.ProcessID, got.ProcessID)
+	be.Equal(t, keyData.SecretKey, got.SecretKey)
+
+	// There is no instance 2.
+	be.Nonzero(t, s.forwardCancel(2, msg))
+}
+
+func TestHandleCancelFromPeer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	be.NilErr(t, err)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	be.NilErr(t, err)
+	defer client.Close()
+	c, err := l.Accept()
+	be.NilErr(t, err)
+	defer c.Close()
+
+	// The request comes from the address of a peer, so it is
+	// not forwarded again, even though it is not for this instance.
+	s := &Server{}
+	s.cfg.Store(&config.Config{ClusterSettings: config.ClusterSettings{
+		InstanceID: 0,
+		Peers:      []string{"127.0.0.1:0", "127.0.0.1:0"},
+	}})
+	s.resolvePeers()
+	msg := &pgproto3.CancelRequest{ProcessID: 1 << 24}
+	err = s.handleCancel(c, msg)
+	be.True(t, errors.Is(err, errForwardedCancel))
+
+	s.cfg.Store(&config.Config{ClusterSettings: config.ClusterSettings{
+		InstanceID: 0,
+		Peers:      []string{"10.0.0.1:5432"},
+	}})
+	s.resolvePeers()
+	be.False(t, s.fromPeer(c.RemoteAddr()))
+}
+
+func TestCancelWithoutServerConn(t *testing.T) {
+	cc := &ClientConn{}
+	// A client which has no server conn has no query to cancel,
+	// and it can be cancelled again.
+	be.NilErr(t, cc.CancelServerConn())
+	be.NilErr(t, cc.CancelServerConn())
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/agnivade/perseus/config"
+)
+
+// maxVerifiedPerEntry bounds the number of password digests
+// remembered for a single auth row.
+const maxVerifiedPerEntry = 4
+
+type credKey struct {
+	db, schema, user string
+}
+
+type credEntry struct {
+	row       AuthRow
+	notFound  bool
+	fetchedAt time.Time
+	// verified holds the digests of the passwords which have
+	// been successfully verified against row.source_pass_hashed.
+	verified [][sha256.Size]byte
+}
+
+// credentialCache is a CredentialStore which caches the rows returned
+// by another store, along with the passwords which were successfully
+// verified against them. This avoids hitting the auth DB and running
+// the (deliberately slow) scrypt verification on every new connection.
+//
+// Rows are refetched after the TTL. Unknown tenants are cached for the
+// negative TTL. If the store fails while refetching, the stale row is served,
+// so that an auth DB outage does not affect tenants which are already cached.
+type credentialCache struct {
+	store       CredentialStore
+	logger      *slog.Logger
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxSize     int
+	// digestKey is a random key used to derive password digests,
+	// so that the digests are useless outside this process.
+	digestKey []byte
+
+	mut     sync.Mutex
+	entries map[credKey]*credEntry
+}
+
+func newCredentialCache(store CredentialStore, settings config.AuthDBSettings, logger *slog.Logger) (*credentialCache, error) {
+	digestKey := make([]byte, 32)
+	if _, err := rand.Read(digestKey); err != nil {
+		return nil, err
+	}
+	maxSize := settings.CacheMaxSize
+	if maxSize <= 0 {
+		maxSize = 10000
+	}
+	return &credentialCache{
+		store:       store,
+		logger:      logger,
+		ttl:         time.Second * time.Duration(settings.CacheTTLSecs),
+		negativeTTL: time.Second * time.Duration(settings.NegativeCacheTTLSecs),
+		maxSize:     maxSize,
+		digestKey:   digestKey,
+		entries:     make(map[credKey]*credEntry),
+	}, nil
+}
+
+func (c *credentialCache) Lookup(ctx context.Context, db, schema, user string) (AuthRow, error) {
+	key := credKey{db: db, schema: schema, user: user}
+
+	c.mut.Lock()
+	entry := c.entries[key]
+	if entry != nil && !c.expiredLocked(entry) {
+		c.mut.Unlock()
+		if entry.notFound {
+			return AuthRow{}, ErrCredentialsNotFound
+		}
+		return entry.row, nil
+	}
+	c.mut.Unlock()
+
+	row, err := c.store.Lookup(ctx, db, schema, user)
+	notFound := errors.Is(err, ErrCredentialsNotFound)
+	if err != nil && !notFound {
+		if entry != nil && !entry.notFound {
+			c.logger.Warn("Error looking up credentials, serving cached entry", "db", db, "schema", schema, "err", err)
+			return entry.row, nil
+		}
+		return row, err
+	}
+
+	newEntry := &credEntry{
+		row:       row,
+		notFound:  notFound,
+		fetchedAt: time.Now(),
+	}
+
+	c.mut.Lock()
+	// Carry over the verified passwords if the hash has not changed.
+	if old := c.entries[key]; old != nil && !old.notFound && !notFound &&
+		old.row.source_pass_hashed == row.source_pass_hashed {
+		newEntry.verified = old.verified
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxSize {
+		c.evictLocked()
+	}
+	c.entries[key] = newEntry
+	c.mut.Unlock()
+
+	return row, err
+}
+
+// isVerified reports whether the password has already been
+// verified against the row. It is safe to call on a nil cache.
+func (c *credentialCache) isVerified(row AuthRow, password string) bool {
+	if c == nil {
+		return false
+	}
+	digest := c.digest(password)
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	entry := c.entries[credKey{db: row.source_db, schema: row.source_schema, user: row.source_user}]
+	if entry == nil || entry.notFound || entry.row.source_pass_hashed != row.source_pass_hashed {
+		return false
+	}
+	for _, d := range entry.verified {
+		if hmac.Equal(d[:], digest[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// markVerified remembers that the password was successfully
+// verified against the row. It is safe to call on a nil cache.
+func (c *credentialCache) markVerified(row AuthRow, password string) {
+	if c == nil {
+		return
+	}
+	digest := c.digest(password)
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	entry := c.entries[credKey{db: row.source_db, schema: row.source_schema, user: row.source_user}]
+	if entry == nil || entry.notFound || entry.row.source_pass_hashed != row.source_pass_hashed {
+		return
+	}
+	if len(entry.verified) >= maxVerifiedPerEntry {
+		entry.verified = entry.verified[1:]
+	}
+	entry.verified = append(entry.verified, digest)
+}
+
+// invalidate drops all cached entries.
+func (c *credentialCache) invalidate() {
+	c.mut.Lock()
+	c.entries = make(map[credKey]*credEntry)
+	c.mut.Unlock()
+}
+
+// reload invalidates the cache, and reloads the underlying store if possible.
+func (c *credentialCache) reload() error {
+	c.invalidate()
+	if r, ok := c.store.(reloader); ok {
+		return r.reload()
+	}
+	return nil
+}
+
+func (c *credentialCache) Close() {
+	c.store.Close()
+}
+
+func (c *credentialCache) digest(password string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, c.digestKey)
+	mac.Write([]byte(password))
+	var d [sha256.Size]byte
+	copy(d[:], mac.Sum(nil))
+	return d
+}
+
+func (c *credentialCache) expiredLocked(entry *credEntry) bool {
+	ttl := c.ttl
+	if entry.notFound {
+		ttl = c.negativeTTL
+	}
+	return time.Since(entry.fetchedAt) > ttl
+}
+
+// evictLocked makes room for one entry by dropping all expired entries,
+// or the oldest one if none have expired.
+func (c *credentialCache) evictLocked() {
+	var oldestKey credKey
+	var oldest *credEntry
+	for key, entry := range c.entries {
+		if c.expiredLocked(entry) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == nil || entry.fetchedAt.Before(oldest.fetchedAt) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	if len(c.entries) >= c.maxSize && oldest != nil {
+		delete(c.entries, oldestKey)
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/agnivade/perseus/config"
+	"github.com/carlmjohnson/be"
+)
+
+type storeMock struct {
+	rows  map[credKey]AuthRow
+	err   error
+	calls int
+}
+
+func (st *storeMock) Lookup(_ context.Context, db, schema, user string) (AuthRow, error) {
+	st.calls++
+	if st.err != nil {
+		return AuthRow{}, st.err
+	}
+	row, ok := st.rows[credKey{db: db, schema: schema, user: user}]
+	if !ok {
+		return row, ErrCredentialsNotFound
+	}
+	return row, nil
+}
+
+func (st *storeMock) Close() {}
+
+func TestCredentialCache(t *testing.T) {
+	row := AuthRow{source_db: "db1", source_schema: "public", source_user: "mmuser", source_pass_hashed: "hash1"}
+	store := &storeMock{rows: map[credKey]AuthRow{{"db1", "public", "mmuser"}: row}}
+	c, err := newCredentialCache(store, config.AuthDBSettings{
+		CacheTTLSecs:         60,
+		NegativeCacheTTLSecs: 60,
+		CacheMaxSize:         2,
+	}, slog.Default())
+	be.NilErr(t, err)
+	ctx := context.Background()
+
+	t.Run("rows are cached", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			got, err := c.Lookup(ctx, "db1", "public", "mmuser")
+			be.NilErr(t, err)
+			be.Equal(t, row, got)
+		}
+		be.Equal(t, 1, store.calls)
+	})
+
+	t.Run("unknown tenants are cached", func(t *testing.T) {
+		store.calls = 0
+		for i := 0; i < 3; i++ {
+			_, err := c.Lookup(ctx, "db2", "public", "mmuser")
+			be.True(t, errors.Is(err, ErrCredentialsNotFound))
+		}
+		be.Equal(t, 1, store.calls)
+	})
+
+	t.Run("verified passwords", func(t *testing.T) {
+		be.False(t, c.isVerified(row, "pass"))
+		c.markVerified(row, "pass")
+		be.True(t, c.isVerified(row, "pass"))
+		be.False(t, c.isVerified(row, "other"))
+
+		changed := row
+		changed.source_pass_hashed = "hash2"
+		be.False(t, c.isVerified(changed, "pass"))
+	})
+
+	t.Run("stale entries are served on error", func(t *testing.T) {
+		c.mut.Lock()
+		c.entries[credKey{"db1", "public", "mmuser"}].fetchedAt = time.Now().Add(-time.Hour)
+		c.mut.Unlock()
+
+		store.err = errors.New("auth db is down")
+		got, err := c.Lookup(ctx, "db1", "public", "mmuser")
+		be.NilErr(t, err)
+		be.Equal(t, row, got)
+
+		_, err = c.Lookup(ctx, "db3", "public", "mmuser")
+		be.Nonzero(t, err)
+		store.err = nil
+	})
+
+	t.Run("size is bounded", func(t *testing.T) {
+		c.invalidate()
+		for _, db := range []string{"a", "b", "c"} {
+			_, err := c.Lookup(ctx, db, "public", "mmuser")
+			be.True(t, errors.Is(err, ErrCredentialsNotFound))
+		}
+		be.Equal(t, 2, len(c.entries))
+	})
+
+	t.Run("invalidate", func(t *testing.T) {
+		c.markVerified(row, "pass")
+		be.NilErr(t, c.reload())
+		be.Equal(t, 0, len(c.entries))
+		be.False(t, c.isVerified(row, "pass"))
+	})
+
+	// A nil cache is used when caching is disabled.
+	var nilCache *credentialCache
+	be.False(t, nilCache.isVerified(row, "pass"))
+	nilCache.markVerified(row, "pass")
+}
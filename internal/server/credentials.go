@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/agnivade/perseus/config"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrCredentialsNotFound is returned by a CredentialStore
+// when there are no credentials for the given key.
+var ErrCredentialsNotFound = errors.New("credentials not found")
+
+// CredentialStore looks up the credentials of a client.
+type CredentialStore interface {
+	// Lookup returns the auth row for the given source database, schema and user.
+	Lookup(ctx context.Context, db, schema, user string) (AuthRow, error)
+	// Close releases any resources held by the store.
+	Close()
+}
+
+// reloader is implemented by stores which can re-read
+// their credentials on a config reload.
+type reloader interface {
+	reload() error
+}
+
+// NewCredentialStore returns the store selected in the settings.
+func NewCredentialStore(settings config.AuthDBSettings) (CredentialStore, error) {
+	switch settings.Store {
+	case "", "postgres":
+		return newPGCredentialStore(settings)
+	case "file":
+		return newFileCredentialStore(settings)
+	case "webhook":
+		return newWebhookCredentialStore(settings)
+	default:
+		return nil, fmt.Errorf("unknown credential store %q", settings.Store)
+	}
+}
+
+// authRowJSON is the JSON representation of an AuthRow,
+// which is used by the file and webhook stores.
+// The keys are the same as the columns in perseus_auth.
+type authRowJSON struct {
+	ID               int    `json:"id"`
+	SourceDB         string `json:"source_db"`
+	SourceSchema     string `json:"source_schema"`
+	SourceUser       string `json:"source_user"`
+	SourcePassHashed string `json:"source_pass_hashed"`
+	DestHost         string `json:"dest_host"`
+	DestUser         string `json:"dest_user"`
+	DestDB           string `json:"dest_db"`
+	DestPassEnc      string `json:"dest_pass_enc"`
+}
+
+func (r authRowJSON) toAuthRow() AuthRow {
+	return AuthRow{
+		id:                 r.ID,
+		source_db:          r.SourceDB,
+		source_schema:      r.SourceSchema,
+		source_user:        r.SourceUser,
+		source_pass_hashed: r.SourcePassHashed,
+		dest_host:          r.DestHost,
+		dest_user:          r.DestUser,
+		dest_db:            r.DestDB,
+		dest_pass_enc:      r.DestPassEnc,
+	}
+}
+
+// pgCredentialStore looks up credentials from the perseus_auth table.
+type pgCredentialStore struct {
+	pool *pgxpool.Pool
+}
+
+func newPGCredentialStore(settings config.AuthDBSettings) (*pgCredentialStore, error) {
+	poolCfg, err := pgxpool.ParseConfig(settings.AuthDBDSN)
+	if err != nil {
+		return nil, fmt.Errorf("error trying to parse pool config %s: %w", settings.AuthDBDSN, err)
+	}
+	authPool, err := pgxpool.NewWithConfig(context.Background(), poolCfg)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing auth pool: %w", err)
+	}
+	return &pgCredentialStore{pool: authPool}, nil
+}
+
+func (st *pgCredentialStore) Lookup(ctx context.Context, db, schema, user string) (AuthRow, error) {
+	var row AuthRow
+	err := st.pool.
+		QueryRow(ctx, "SELECT id, source_db, source_schema, source_user, source_pass_hashed, dest_host, dest_user, dest_db, dest_pass_enc FROM perseus_auth WHERE source_db=$1 AND source_schema=$2 AND source_user=$3", db, schema, user).
+		Scan(&row.id, &row.source_db, &row.source_schema, &row.source_user, &row.source_pass_hashed, &row.dest_host, &row.dest_user, &row.dest_db, &row.dest_pass_enc)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return row, ErrCredentialsNotFound
+	}
+	return row, err
+}
+
+func (st *pgCredentialStore) Close() {
+	st.pool.Close()
+}
+
+// fileCredentialStore serves credentials from a JSON file
+// containing an array of rows. It is meant for test environments
+// and small installs which do not have a separate auth database.
+// The file is re-read on reload.
+type fileCredentialStore struct {
+	path string
+
+	mut  sync.RWMutex
+	rows map[[3]string]AuthRow
+}
+
+func newFileCredentialStore(settings config.AuthDBSettings) (*fileCredentialStore, error) {
+	st := &fileCredentialStore{path: settings.AuthFile}
+	if err := st.load(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (st *fileCredentialStore) load() error {
+	buf, err := os.ReadFile(st.path)
+	if err != nil {
+		return fmt.Errorf("could not read auth file: %w", err)
+	}
+
+	var jsonRows []authRowJSON
+	if err := json.Unmarshal(buf, &jsonRows); err != nil {
+		return fmt.Errorf("could not decode auth file: %w", err)
+	}
+
+	rows := make(map[[3]string]AuthRow, len(jsonRows))
+	for _, r := range jsonRows {
+		rows[[3]string{r.SourceDB, r.SourceSchema, r.SourceUser}] = r.toAuthRow()
+	}
+
+	st.mut.Lock()
+	st.rows = rows
+	st.mut.Unlock()
+	return nil
+}
+
+func (st *fileCredentialStore) reload() error {
+	return st.load()
+}
+
+func (st *fileCredentialStore) Lookup(_ context.Context, db, schema, user string) (AuthRow, error) {
+	st.mut.RLock()
+	defer st.mut.RUnlock()
+	row, ok := st.rows[[3]string{db, schema, user}]
+	if !ok {
+		return row, ErrCredentialsNotFound
+	}
+	return row, nil
+}
+
+func (st *fileCredentialStore) Close() {}
+
+// webhookCredentialStore asks an HTTP endpoint for the credentials.
+// The request is a POST with a JSON body containing source_db,
+// source_schema and source_user. The endpoint should reply with a row
+// in the same format as the file store, or a 404 if there are no credentials.
+type webhookCredentialStore struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newWebhookCredentialStore(settings config.AuthDBSettings) (*webhookCredentialStore, error) {
+	if settings.WebhookURL == "" {
+		return nil, errors.New("webhook URL is not set")
+	}
+	return &webhookCredentialStore{
+		url:    settings.WebhookURL,
+		token:  settings.WebhookToken,
+		client: &http.Client{},
+	}, nil
+}
+
+func (st *webhookCredentialStore) Lookup(ctx context.Context, db, schema, user string) (AuthRow, error) {
+	body, err := json.Marshal(authRowJSON{SourceDB: db, SourceSchema: schema, SourceUser: user})
+	if err != nil {
+		return AuthRow{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, st.url, bytes.NewReader(body))
+	if err != nil {
+		return AuthRow{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if st.token != "" {
+		req.Header.Set("Authorization", "Bearer "+st.token)
+	}
+
+	resp, err := st.client.Do(req)
+	if err != nil {
+		return AuthRow{}, fmt.Errorf("error calling webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return AuthRow{}, ErrCredentialsNotFound
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return AuthRow{}, fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, msg)
+	}
+
+	var r authRowJSON
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return AuthRow{}, fmt.Errorf("error decoding webhook response: %w", err)
+	}
+	return r.toAuthRow(), nil
+}
+
+func (st *webhookCredentialStore) Close() {
+	st.client.CloseIdleConnections()
+}
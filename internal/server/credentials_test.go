@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/agnivade/perseus/config"
+	"github.com/carlmjohnson/be"
+)
+
+func TestFileCredentialStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	be.NilErr(t, os.WriteFile(path, []byte(`[{"source_db": "db1", "source_schema": "public", "source_user": "mmuser", "dest_host": "localhost:5432"}]`), 0600))
+
+	st, err := NewCredentialStore(config.AuthDBSettings{Store: "file", AuthFile: path})
+	be.NilErr(t, err)
+	defer st.Close()
+
+	row, err := st.Lookup(context.Background(), "db1", "public", "mmuser")
+	be.NilErr(t, err)
+	be.Equal(t, "mmuser", row.source_user)
+	be.Equal(t, "localhost:5432", row.dest_host)
+
+	_, err = st.Lookup(context.Background(), "db1", "other", "mmuser")
+	be.True(t, errors.Is(err, ErrCredentialsNotFound))
+
+	_, err = st.Lookup(context.Background(), "db1", "public", "other")
+	be.True(t, errors.Is(err, ErrCredentialsNotFound))
+}
+
+func TestWebhookCredentialStore(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req authRowJSON
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.SourceDB != "db1" || req.SourceUser != "mmuser" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(req)
+	}))
+	defer srv.Close()
+
+	st, err := NewCredentialStore(config.AuthDBSettings{Store: "webhook", WebhookURL: srv.URL, WebhookToken: "secret"})
+	be.NilErr(t, err)
+	defer st.Close()
+
+	row, err := st.Lookup(context.Background(), "db1", "public", "mmuser")
+	be.NilErr(t, err)
+	be.Equal(t, "mmuser", row.source_user)
+	be.Equal(t, "public", row.source_schema)
+
+	_, err = st.Lookup(context.Background(), "db2", "public", "mmuser")
+	be.True(t, errors.Is(err, ErrCredentialsNotFound))
+
+	st, err = NewCredentialStore(config.AuthDBSettings{Store: "webhook", WebhookURL: srv.URL})
+	be.NilErr(t, err)
+	_, err = st.Lookup(context.Background(), "db1", "public", "mmuser")
+	be.Nonzero(t, err)
+}
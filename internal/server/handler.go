@@ -3,15 +3,15 @@ package server
 import (
 	"context"
 	"crypto/rand"
-	"encoding/base64"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"math"
 	"math/big"
 	"net"
+	"sort"
 	"time"
 
-	scrypt "github.com/agnivade/easy-scrypt"
 	"github.com/jackc/pgx/v5/pgproto3"
 )
 
@@ -19,7 +19,13 @@ type startupParams struct {
 	username string
 	database string
 	schema   string
-	password string
+	// searchPath is the parsed schema, set once it is validated.
+	searchPath []string
+	// session holds the tracked session parameters sent by the client.
+	session map[string]string
+	// serverCert is the DER encoded certificate presented
+	// to the client, or nil if the connection is not over TLS.
+	serverCert []byte
 }
 
 type AuthRow struct {
@@ -40,77 +46,112 @@ type AuthRow struct {
 var ErrCancelComplete = errors.New("cancel complete")
 
 func (s *Server) handleConn(c net.Conn) (err error) {
-	handle := pgproto3.NewBackend(c, c)
-	params, err := s.handleStartup(handle)
+	params, handle, err := s.handleStartup(c)
 	if err != nil {
 		return err
 	}
 
 	if params.database == "" {
-		msg := "empty database name received in params"
-		sendAndFlush(handle, msg)
-		return errors.New(msg)
+		err := fatalf(codeInvalidCatalogName, "empty database name received in params")
+		sendAndFlush(handle, err)
+		return err
+	}
+
+	if s.isAdminDB(params.database) {
+		return s.handleAdminConn(c, handle, params)
 	}
 
+	logger := s.logger.With("client_addr", c.RemoteAddr().String(),
+		"user", params.username, "db", params.database, "schema", params.schema)
+
 	if params.schema == "" {
-		msg := "empty schema name received in params"
-		sendAndFlush(handle, msg)
-		return errors.New(msg)
+		err := fatalf(codeInvalidSchemaName, "empty schema name received in params")
+		sendAndFlush(handle, err)
+		return err
+	}
+
+	searchPath, err := parseSearchPath(params.schema)
+	if err != nil {
+		err := fatalf(codeInvalidSchemaName, "invalid schema search path: %v", err)
+		sendAndFlush(handle, err)
+		return err
 	}
 
 	if params.username == "" {
-		msg := "empty user name received in params"
-		sendAndFlush(handle, msg)
-		return errors.New(msg)
+		err := fatalf(codeInvalidAuthorization, "empty user name received in params")
+		sendAndFlush(handle, err)
+		return err
+	}
+
+	ipKey := "ip:" + remoteIP(c)
+	tenantKey := "tenant:" + params.database + "/" + params.schema
+	if err := s.limiter.check(ipKey, tenantKey); err != nil {
+		logger.Warn("Rejecting login", "err", err)
+		sendAndFlush(handle, fatalf(errorCode(err, codeInvalidAuthorization), "%v", err))
+		return err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(s.cfg.AuthDBSettings.AuthQueryTimeoutSecs))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(s.cfg.Load().AuthDBSettings.AuthQueryTimeoutSecs))
 	defer cancel()
-	var row AuthRow
-	err = s.authPool.
-		QueryRow(ctx, "SELECT id, source_db, source_schema, source_user, source_pass_hashed, dest_host, dest_user, dest_db, dest_pass_enc FROM perseus_auth WHERE source_db=$1 AND source_schema=$2", params.database, params.schema).
-		Scan(&row.id, &row.source_db, &row.source_schema, &row.source_user, &row.source_pass_hashed, &row.dest_host, &row.dest_user, &row.dest_db, &row.dest_pass_enc)
+	row, err := s.creds.Lookup(ctx, params.database, params.schema, params.username)
+	if err == nil && (row.source_user != params.username || !sameSearchPath(row.source_schema, searchPath)) {
+		// Guard against a store which does not match on the user or the schema.
+		err = ErrCredentialsNotFound
+	}
+	if errors.Is(err, ErrCredentialsNotFound) {
+		// The tenant might not exist, so only the IP is counted. Otherwise,
+		// made up tenants would fill the limiter with keys of their own.
+		s.limiter.fail(ipKey)
+		logger.Warn("Authentication failed: no credentials for user")
+		return s.rejectUnknownUser(handle, params)
+	}
 	if err != nil {
-		msg := fmt.Sprintf("error querying the auth table: %v", err)
-		sendAndFlush(handle, msg)
-		return errors.New(msg)
+		// The auth DB is down or slow, the client can try again later.
+		err := fatalf(codeCannotConnectNow, "error querying the auth table: %v", err)
+		sendAndFlush(handle, err)
+		return err
 	}
 
-	decPass, err := base64.StdEncoding.DecodeString(row.source_pass_hashed)
-	if err != nil {
-		msg := fmt.Sprintf("error decoding from base64: %v", err)
-		sendAndFlush(handle, msg)
-		return errors.New(msg)
+	if err := s.authenticate(handle, params, row); err != nil {
+		if errors.Is(err, ErrPasswordMismatch) {
+			s.limiter.fail(ipKey, tenantKey)
+		}
+		return err
 	}
+	// The failures of the IP are kept, so that a client which
+	// knows one password cannot reset the count of its IP.
+	s.limiter.succeed(tenantKey)
+	params.searchPath = searchPath
 
-	ok, err := scrypt.VerifyPassphrase(params.password, decPass)
+	pool, err := s.poolMgr.GetOrCreatePool(row)
 	if err != nil {
-		msg := fmt.Sprintf("error verifying password: %v", err)
-		sendAndFlush(handle, msg)
-		return errors.New(msg)
+		err := fatalf(errorCode(err, codeCannotConnect), "error while acquiring a pool: %v", err)
+		sendAndFlush(handle, err)
+		return err
 	}
-	if !ok {
-		msg := fmt.Sprintf("password mismatch")
-		sendAndFlush(handle, msg)
-		return errors.New(msg)
+	mode, err := s.poolMgr.PoolMode(row)
+	if err != nil {
+		err := fatalf(codeConfigFileError, "%v", err)
+		sendAndFlush(handle, err)
+		return err
+	}
+	serverParams, err := pool.ServerParams()
+	if err != nil {
+		err := fatalf(errorCode(err, codeCannotConnect), "error while connecting to the destination: %v", err)
+		sendAndFlush(handle, err)
+		return err
 	}
 
 	handle.Send(&pgproto3.AuthenticationOk{})
-	keyData := pgproto3.BackendKeyData{
-		ProcessID: s.getRandUint32(),
-		SecretKey: s.getRandUint32(),
-	}
+	sendParameterStatus(handle, serverParams, params.session)
+	keyData := s.newKeyData()
 	handle.Send(&keyData)
 	handle.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
 	if err := handle.Flush(); err != nil {
 		return fmt.Errorf("error while flushing authOK: %w", err)
 	}
-
-	pool, err := s.poolMgr.GetOrCreatePool(row)
-	if err != nil {
-		return fmt.Errorf("error while acquiring a pool: %w", err)
-	}
-	cc := NewClientConn(handle, s.logger, pool, params.schema)
+	logger = logger.With("dest_host", row.dest_host, "dest_db", row.dest_db)
+	cc := NewClientConn(handle, logger, pool, mode, params, c, s.metrics.forDest(row.dest_host, row.dest_db))
 
 	s.keyDataMut.Lock()
 	s.keyDataMap[keyData] = cc
@@ -119,9 +160,15 @@ func (s *Server) handleConn(c net.Conn) (err error) {
 	defer func() {
 		cc.mut.Lock()
 		if cc.serverConn != nil {
-			if err != nil || cc.txStatus != StatusUnset /* This takes of care TxStatus = E */ {
+			if err == nil && cc.txStatus == StatusIdle {
+				// A session mode client which left cleanly.
+				cc.releaseConnLocked()
+			} else {
+				// The conn might be in the middle of a transaction,
+				// or in an unknown state after an error.
+				pid := cc.serverConn.PID()
 				if err2 := cc.serverConn.Close(); err2 != nil {
-					s.logger.Printf("Error while destroying conn: %v\n", err2)
+					logger.Error("Error while destroying conn", "backend_pid", pid, "err", err2)
 				}
 				cc.serverConn = nil
 			}
@@ -136,117 +183,175 @@ func (s *Server) handleConn(c net.Conn) (err error) {
 	// enter command cycle
 	var feMsg pgproto3.FrontendMessage
 	for {
-		// resetting txStatus
-		cc.txStatus = StatusUnset
-
+		if cc.keepsIdleConn() {
+			cc.startRelay()
+		}
 		feMsg, err = cc.handle.Receive()
+		if cc.relayDone != nil {
+			if err2 := cc.stopRelay(); err2 != nil {
+				// The session of the server conn, which the client relies
+				// on while it holds the conn idle, is gone.
+				sendAndFlush(cc.handle, fatalf(codeConnectionFailure, "lost the connection to the server: %v", err2))
+				return err2
+			}
+		}
 		if err != nil {
 			return fmt.Errorf("error while receiving from client conn: %w", err)
 		}
 
 		switch feMsg.(type) {
-		case *pgproto3.Query:
+		case *pgproto3.Query,
+			*pgproto3.FunctionCall:
 			err = cc.handleQuery(feMsg)
 			if err != nil {
 				return err
 			}
 		case *pgproto3.Parse,
-			*pgproto3.Bind:
+			*pgproto3.Bind,
+			*pgproto3.Describe,
+			*pgproto3.Execute,
+			*pgproto3.Close,
+			*pgproto3.Sync,
+			*pgproto3.Flush:
 			err = cc.handleExtendedQuery(feMsg)
 			if err != nil {
 				return err
 			}
+		case *pgproto3.CopyData,
+			*pgproto3.CopyDone,
+			*pgproto3.CopyFail:
+			// Left over from a copy which failed. The server
+			// ignores these outside a copy as well.
 		case *pgproto3.Terminate:
-			s.logger.Println("Received terminate msg, closing connection")
+			logger.Debug("Received terminate msg, closing connection")
 			return nil
 		default:
-			s.logger.Printf("Received some other msg: %T, cannot handle. Closing\n", feMsg)
+			logger.Warn("Received unsupported msg, closing connection", "msg_type", fmt.Sprintf("%T", feMsg))
 			return nil
 		}
 	}
 }
 
-func (s *Server) handleStartup(handle *pgproto3.Backend) (*startupParams, error) {
+// handleStartup reads the startup message from the client and returns
+// the startup params along with the handle to use for the rest of the
+// connection. The handle wraps a TLS connection if the client requested
+// and was granted an upgrade.
+func (s *Server) handleStartup(c net.Conn) (*startupParams, *pgproto3.Backend, error) {
+	handle := pgproto3.NewBackend(c, c)
 	startupMsg, err := handle.ReceiveStartupMessage()
 	if err != nil {
-		return nil, fmt.Errorf("error while receiving startup message: %w", err)
+		return nil, nil, fmt.Errorf("error while receiving startup message: %w", err)
 	}
 
 	switch typedMsg := startupMsg.(type) {
 	case *pgproto3.StartupMessage:
-		// We send in cleartext because we hash with a better
-		// algorithm than MD5. Ideally, we should use SCRAM.
-		handle.Send(&pgproto3.AuthenticationCleartextPassword{})
-		if err := handle.Flush(); err != nil {
-			return nil, fmt.Errorf("error while flushing authPasswd: %w", err)
+		if s.clientTLS.Load().require && !isTLS(c) {
+			err := fatalf(codeInvalidAuthorization, "SSL connection is required")
+			sendAndFlush(handle, err)
+			return nil, nil, err
 		}
 
-		pass, err := handle.Receive()
-		if err != nil {
-			return nil, err
-		}
-		typedPass, ok := pass.(*pgproto3.PasswordMessage)
-		if !ok {
-			return nil, errors.New("didn't receive password message")
+		schema := typedMsg.Parameters["schema_search_path"]
+		if schema == "" {
+			// Unmodified clients can only pass it with -c search_path=.
+			schema = parseOptions(typedMsg.Parameters["options"])["search_path"]
 		}
 		return &startupParams{
 			username: typedMsg.Parameters["user"],
 			database: typedMsg.Parameters["database"],
-			schema:   typedMsg.Parameters["schema_search_path"],
-			password: typedPass.Password,
-		}, nil
+			schema:   schema,
+			session:  sessionParams(typedMsg.Parameters),
+		}, handle, nil
 	case *pgproto3.SSLRequest:
-		handle.Send(&denySSL{})
-		if err := handle.Flush(); err != nil {
-			return nil, fmt.Errorf("error while flushing denySSL: %w", err)
+		tlsCfg := s.clientTLS.Load().config
+		// A client should not ask twice, but if it does, we just deny.
+		if tlsCfg == nil || isTLS(c) {
+			handle.Send(sslResponse('N'))
+			if err := handle.Flush(); err != nil {
+				return nil, nil, fmt.Errorf("error while flushing denySSL: %w", err)
+			}
+			return s.handleStartup(c)
 		}
-		return s.handleStartup(handle)
-	case *pgproto3.CancelRequest:
-		var toCancel *ClientConn
-		s.keyDataMut.Lock()
-		toCancel = s.keyDataMap[pgproto3.BackendKeyData{
-			ProcessID: typedMsg.ProcessID,
-			SecretKey: typedMsg.SecretKey,
-		}]
-		s.keyDataMut.Unlock()
 
-		// A client connection should exist
-		if toCancel == nil {
-			return nil, fmt.Errorf("connection not found with given cancel request: %v", typedMsg)
+		handle.Send(sslResponse('S'))
+		if err := handle.Flush(); err != nil {
+			return nil, nil, fmt.Errorf("error while flushing acceptSSL: %w", err)
 		}
 
-		s.logger.Println("Handling CancelRequest")
-		if err := toCancel.CancelServerConn(); err != nil {
-			return nil, fmt.Errorf("error while cancelling server conn: %w", err)
+		tlsConn := tls.Server(c, tlsCfg)
+		ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+		defer cancel()
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, nil, fmt.Errorf("error during TLS handshake: %w", err)
 		}
-
-		return nil, ErrCancelComplete
+		params, handle, err := s.handleStartup(tlsConn)
+		if params != nil {
+			params.serverCert = tlsCfg.Certificates[0].Certificate[0]
+		}
+		return params, handle, err
+	case *pgproto3.CancelRequest:
+		if err := s.handleCancel(c, typedMsg); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrCancelComplete
 	}
 
-	return nil, fmt.Errorf("unexpected startup msg: %T", startupMsg)
+	return nil, nil, fmt.Errorf("unexpected startup msg: %T", startupMsg)
 }
 
-type denySSL struct {
-}
+// sslResponse is the single byte reply to an SSLRequest.
+// 'S' accepts the upgrade, and 'N' denies it.
+type sslResponse byte
 
-func (*denySSL) Backend() {}
+func (sslResponse) Backend() {}
 
-func (dst *denySSL) Decode(src []byte) error {
+func (dst sslResponse) Decode(src []byte) error {
 	return nil
 }
-func (src *denySSL) Encode(dst []byte) []byte {
-	return append(dst, 'N')
+func (src sslResponse) Encode(dst []byte) []byte {
+	return append(dst, byte(src))
 }
 
-func sendAndFlush(handle *pgproto3.Backend, msg string) {
-	handle.Send(&pgproto3.ErrorResponse{Message: msg})
+// sendParameterStatus reports the server params to the client. The session
+// params set by the client take precedence, since they are applied to every
+// server conn the client uses.
+func sendParameterStatus(handle *pgproto3.Backend, serverParams, session map[string]string) {
+	merged := make(map[string]string, len(serverParams)+len(session))
+	for name, value := range serverParams {
+		merged[name] = value
+	}
+	for name, value := range session {
+		merged[name] = value
+	}
+
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		handle.Send(&pgproto3.ParameterStatus{Name: name, Value: merged[name]})
+	}
+}
+
+func sendAndFlush(handle *pgproto3.Backend, err *pgError) {
+	handle.Send(err.response())
 	handle.Flush()
 }
 
+// remoteIP returns the IP of the client, without the port.
+func remoteIP(c net.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
 func (s *Server) getRandUint32() uint32 {
 	n, err := rand.Int(rand.Reader, big.NewInt(math.MaxUint32-1))
 	if err != nil {
-		s.logger.Printf("Error while generating random number: %v", err)
+		s.logger.Error("Error while generating random number", "err", err)
 		return 0
 	}
 	return uint32(n.Int64())
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/agnivade/perseus/config"
+)
+
+var (
+	ErrLockedOut       = errors.New("too many failed login attempts, try again later")
+	ErrTooManyVerifies = errors.New("too many concurrent logins, try again later")
+)
+
+// maxLimiterEntries is the maximum number of tracked keys. Once it is
+// reached, entries which are no longer relevant are swept, and if there
+// are none, the entry with the oldest failure makes room for the new one.
+const maxLimiterEntries = 10000
+
+type failureEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+	// lockouts is the number of consecutive lockouts, used
+	// to grow the lockout duration exponentially.
+	lockouts int
+}
+
+// loginLimiter protects against brute forcing logins. It counts failed
+// logins per key, where a key is a source IP or a database and schema, and
+// locks the key out once it sees too many of them. It also caps the number
+// of concurrent password verifications, since scrypt is deliberately expensive.
+type loginLimiter struct {
+	logger   *slog.Logger
+	settings atomic.Pointer[limiterSettings]
+
+	mut     sync.Mutex
+	entries map[string]*failureEntry
+
+	succeededLogins atomic.Int64 // Total number of successful logins.
+	failedLogins    atomic.Int64 // Total number of failed logins.
+	lockouts        atomic.Int64 // Total number of lockouts.
+}
+
+// limiterSettings are the settings of a loginLimiter.
+// They are swapped as a whole on reload.
+type limiterSettings struct {
+	maxFailures int
+	window      time.Duration
+	lockout     time.Duration
+	maxLockout  time.Duration
+	// verifySem is nil if verifications are not capped.
+	verifySem chan struct{}
+}
+
+func newLimiterSettings(settings config.SecuritySettings) *limiterSettings {
+	st := &limiterSettings{
+		maxFailures: settings.MaxFailedLogins,
+		window:      time.Second * time.Duration(settings.FailureWindowSecs),
+		lockout:     time.Second * time.Duration(settings.LockoutSecs),
+		maxLockout:  time.Second * time.Duration(settings.MaxLockoutSecs),
+	}
+	if st.lockout <= 0 {
+		st.lockout = time.Minute
+	}
+	if st.maxLockout < st.lockout {
+		st.maxLockout = st.lockout
+	}
+	if settings.MaxConcurrentVerifications > 0 {
+		st.verifySem = make(chan struct{}, settings.MaxConcurrentVerifications)
+	}
+	return st
+}
+
+func newLoginLimiter(settings config.SecuritySettings, logger *slog.Logger) *loginLimiter {
+	l := &loginLimiter{
+		logger:  logger,
+		entries: make(map[string]*failureEntry),
+	}
+	l.settings.Store(newLimiterSettings(settings))
+	return l
+}
+
+// reload applies new settings. The failures and lockouts seen so far are
+// kept. If the cap on verifications changes, the verifications running at
+// the time do not count towards the new one.
+func (l *loginLimiter) reload(settings config.SecuritySettings) {
+	st := newLimiterSettings(settings)
+	if old := l.settings.Load(); old.verifySem != nil && cap(old.verifySem) == settings.MaxConcurrentVerifications {
+		st.verifySem = old.verifySem
+	}
+	l.settings.Store(st)
+}
+
+// check returns ErrLockedOut if any of the keys is locked out.
+func (l *loginLimiter) check(keys ...string) error {
+	if l.settings.Load().maxFailures <= 0 {
+		return nil
+	}
+	now := time.Now()
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	for _, key := range keys {
+		if entry := l.entries[key]; entry != nil && now.Before(entry.lockedUntil) {
+			return ErrLockedOut
+		}
+	}
+	return nil
+}
+
+// fail records a failed login for all the keys,
+// and locks out the keys which crossed the limit.
+func (l *loginLimiter) fail(keys ...string) {
+	l.failedLogins.Add(1)
+	st := l.settings.Load()
+	if st.maxFailures <= 0 {
+		return
+	}
+	now := time.Now()
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	for _, key := range keys {
+		entry := l.entries[key]
+		if entry == nil {
+			if len(l.entries) >= maxLimiterEntries {
+				l.sweepLocked(st, now)
+			}
+			if len(l.entries) >= maxLimiterEntries {
+				l.evictOldestLocked()
+			}
+			entry = &failureEntry{}
+			l.entries[key] = entry
+		}
+		if st.window > 0 && now.Sub(entry.lastFailure) > st.window {
+			entry.failures = 0
+		}
+		entry.failures++
+		entry.lastFailure = now
+		if entry.failures < st.maxFailures {
+			continue
+		}
+
+		d := st.lockout << entry.lockouts
+		if d > st.maxLockout || d <= 0 {
+			d = st.maxLockout
+		}
+		entry.lockouts++
+		entry.failures = 0
+		entry.lockedUntil = now.Add(d)
+		l.lockouts.Add(1)
+		l.logger.Warn("Locking out after too many failed logins", "key", key, "duration", d, "failures", st.maxFailures)
+	}
+}
+
+// succeed forgets the failures of all the keys.
+func (l *loginLimiter) succeed(keys ...string) {
+	l.succeededLogins.Add(1)
+	if l.settings.Load().maxFailures <= 0 {
+		return
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	for _, key := range keys {
+		delete(l.entries, key)
+	}
+}
+
+// sweepLocked drops the entries which are neither locked out,
+// nor have failures which could still count towards a lockout.
+func (l *loginLimiter) sweepLocked(st *limiterSettings, now time.Time) {
+	retention := st.window
+	if retention < st.maxLockout {
+		retention = st.maxLockout
+	}
+	for key, entry := range l.entries {
+		if now.After(entry.lockedUntil) && now.Sub(entry.lastFailure) > retention {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// evictOldestLocked drops the entry with the oldest failure.
+func (l *loginLimiter) evictOldestLocked() {
+	var (
+		oldestKey string
+		oldest    time.Time
+	)
+	for key, entry := range l.entries {
+		if oldestKey == "" || entry.lastFailure.Before(oldest) {
+			oldestKey, oldest = key, entry.lastFailure
+		}
+	}
+	delete(l.entries, oldestKey)
+}
+
+// acquireVerify waits for a verification slot for up to timeout.
+// The returned function must be called to release the slot.
+func (l *loginLimiter) acquireVerify(timeout time.Duration) (func(), error) {
+	// The slot is released to the semaphore it was taken
+	// from, even if the settings are reloaded meanwhile.
+	sem := l.settings.Load().verifySem
+	if sem == nil {
+		return func() {}, nil
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-t.C:
+		return nil, ErrTooManyVerifies
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/agnivade/perseus/config"
+	"github.com/carlmjohnson/be"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	l := newLoginLimiter(config.SecuritySettings{
+		MaxFailedLogins:            3,
+		LockoutSecs:                10,
+		MaxLockoutSecs:             25,
+		MaxConcurrentVerifications: 1,
+	}, slog.Default())
+
+	for i := 0; i < 2; i++ {
+		l.fail("ip:1", "tenant:a")
+		be.NilErr(t, l.check("ip:1", "tenant:a"))
+	}
+	l.fail("ip:2", "tenant:a")
+	be.NilErr(t, l.check("ip:2"))
+	be.True(t, errors.Is(l.check("ip:3", "tenant:a"), ErrLockedOut))
+	be.NilErr(t, l.check("ip:3", "tenant:b"))
+	be.Equal(t, int64(3), l.failedLogins.Load())
+	be.Equal(t, int64(1), l.lockouts.Load())
+
+	// Lockouts double with every consecutive lockout, up to the max.
+	lockedFor := func(key string) time.Duration {
+		return time.Until(l.entries[key].lockedUntil).Round(time.Second)
+	}
+	be.Equal(t, 10*time.Second, lockedFor("tenant:a"))
+	for i := 0; i < 3; i++ {
+		l.fail("tenant:a")
+	}
+	be.Equal(t, 20*time.Second, lockedFor("tenant:a"))
+	for i := 0; i < 3; i++ {
+		l.fail("tenant:a")
+	}
+	be.Equal(t, 25*time.Second, lockedFor("tenant:a"))
+
+	l.succeed("tenant:a")
+	be.NilErr(t, l.check("tenant:a"))
+
+	release, err := l.acquireVerify(time.Second)
+	be.NilErr(t, err)
+	_, err = l.acquireVerify(10 * time.Millisecond)
+	be.True(t, errors.Is(err, ErrTooManyVerifies))
+	release()
+	release, err = l.acquireVerify(time.Second)
+	be.NilErr(t, err)
+	release()
+
+	// A reload which disables lockouts lets locked out keys in.
+	l.fail("ip:1")
+	be.True(t, errors.Is(l.check("ip:1"), ErrLockedOut))
+	l.reload(config.SecuritySettings{})
+	be.NilErr(t, l.check("ip:1"))
+	_, err = l.acquireVerify(10 * time.Millisecond)
+	be.NilErr(t, err)
+}
+
+func TestLoginLimiterMaxEntries(t *testing.T) {
+	l := newLoginLimiter(config.SecuritySettings{
+		MaxFailedLogins: 1,
+		LockoutSecs:     60,
+	}, slog.Default())
+
+	// Locked out keys cannot be swept, so the oldest ones are evicted.
+	for i := 0; i < maxLimiterEntries+10; i++ {
+		l.fail(fmt.Sprintf("ip:%d", i))
+	}
+	be.Equal(t, maxLimiterEntries, len(l.entries))
+	be.True(t, errors.Is(l.check(fmt.Sprintf("ip:%d", maxLimiterEntries+9)), ErrLockedOut))
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/agnivade/perseus/config"
+)
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithLogger makes the server log to the given logger, instead of
+// creating one from the config. LogSettings are ignored in that case.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// newLogger creates the logger described by the settings.
+// The level is stored in level, so that it can be changed on reload.
+func newLogger(settings config.LogSettings, w io.Writer, level *slog.LevelVar) (*slog.Logger, error) {
+	lvl, err := parseLogLevel(settings.Level)
+	if err != nil {
+		return nil, err
+	}
+	level.Set(lvl)
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(settings.Format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", settings.Format)
+	}
+}
+
+// parseLogLevel parses one of debug, info, warn or error. Defaults to info.
+func parseLogLevel(s string) (slog.Level, error) {
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+	return lvl, nil
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/agnivade/perseus/config"
+	"github.com/carlmjohnson/be"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+	logger, err := newLogger(config.LogSettings{Level: "warn", Format: "json"}, &buf, level)
+	be.NilErr(t, err)
+
+	logger.Info("dropped")
+	be.Equal(t, 0, buf.Len())
+
+	logger.Warn("kept", "dest_host", "localhost")
+	var entry map[string]any
+	be.NilErr(t, json.Unmarshal(buf.Bytes(), &entry))
+	be.Equal(t, "WARN", entry["level"])
+	be.Equal(t, "localhost", entry["dest_host"])
+
+	// The level can be changed afterwards.
+	buf.Reset()
+	level.Set(slog.LevelDebug)
+	logger.Debug("kept")
+	be.True(t, buf.Len() > 0)
+
+	_, err = newLogger(config.LogSettings{Level: "loud"}, &buf, level)
+	be.Nonzero(t, err)
+	_, err = newLogger(config.LogSettings{Format: "xml"}, &buf, level)
+	be.Nonzero(t, err)
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "perseus"
+
+// destLabels are the labels of the per destination metrics.
+var destLabels = []string{"host", "db"}
+
+// poolLabels are the labels of the pool metrics. The tenant is empty,
+// unless the tenant has a pool of its own.
+var poolLabels = []string{"host", "db", "tenant"}
+
+// metrics holds the metrics which are updated as things happen.
+// Pool stats are read when scraped, by poolCollector.
+type metrics struct {
+	registry *prometheus.Registry
+
+	clientConns      prometheus.Gauge
+	clientConnsTotal prometheus.Counter
+	acquireWait      *prometheus.HistogramVec
+	queryDuration    *prometheus.HistogramVec
+	txDuration       *prometheus.HistogramVec
+}
+
+// destMetrics are the metrics of a single destination.
+type destMetrics struct {
+	acquireWait   prometheus.Observer
+	queryDuration prometheus.Observer
+	txDuration    prometheus.Observer
+}
+
+func newMetrics(s *Server) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		clientConns: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "client_connections",
+			Help:      "The number of open client connections.",
+		}),
+		clientConnsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "client_connections_total",
+			Help:      "The total number of accepted client connections.",
+		}),
+		acquireWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "pool_acquire_wait_seconds",
+			Help:      "The time taken to acquire a server connection from the pool.",
+			Buckets:   []float64{.0005, .001, .005, .01, .05, .1, .5, 1, 5, 10, 30},
+		}, destLabels),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "query_duration_seconds",
+			Help:      "The time from sending a query to the server until it is ready for the next one.",
+			Buckets:   prometheus.DefBuckets,
+		}, destLabels),
+		txDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "transaction_duration_seconds",
+			Help:      "The time a client holds a server connection, from acquiring it until the transaction ends.",
+			Buckets:   prometheus.DefBuckets,
+		}, destLabels),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.clientConns,
+		m.clientConnsTotal,
+		m.acquireWait,
+		m.queryDuration,
+		m.txDuration,
+		&poolCollector{poolMgr: s.poolMgr},
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "auth_successes_total",
+			Help:      "The total number of successful logins.",
+		}, func() float64 { return float64(s.limiter.succeededLogins.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "auth_failures_total",
+			Help:      "The total number of failed logins.",
+		}, func() float64 { return float64(s.limiter.failedLogins.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "auth_lockouts_total",
+			Help:      "The total number of lockouts due to failed logins.",
+		}, func() float64 { return float64(s.limiter.lockouts.Load()) }),
+	)
+	return m
+}
+
+func (m *metrics) forDest(host, db string) *destMetrics {
+	return &destMetrics{
+		acquireWait:   m.acquireWait.WithLabelValues(host, db),
+		queryDuration: m.queryDuration.WithLabelValues(host, db),
+		txDuration:    m.txDuration.WithLabelValues(host, db),
+	}
+}
+
+// serveMetrics starts serving /metrics on the address.
+func (s *Server) serveMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error trying to listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+	s.metricsSrv = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := s.metricsSrv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("Error serving metrics", "err", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) stopMetrics() {
+	if s.metricsSrv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.metricsSrv.Shutdown(ctx); err != nil {
+		s.logger.Error("Error shutting down metrics server", "err", err)
+	}
+}
+
+// poolCollector exports the stats of all pools when scraped.
+type poolCollector struct {
+	poolMgr *PoolManager
+}
+
+var (
+	poolOpenDesc = prometheus.NewDesc(metricsNamespace+"_pool_open_connections",
+		"The number of established server connections, both in use and idle.", poolLabels, nil)
+	poolInUseDesc = prometheus.NewDesc(metricsNamespace+"_pool_in_use_connections",
+		"The number of server connections currently in use.", poolLabels, nil)
+	poolIdleDesc = prometheus.NewDesc(metricsNamespace+"_pool_idle_connections",
+		"The number of idle server connections.", poolLabels, nil)
+	poolWaitingDesc = prometheus.NewDesc(metricsNamespace+"_pool_waiting_clients",
+		"The number of clients waiting for a server connection.", poolLabels, nil)
+	poolWaitCountDesc = prometheus.NewDesc(metricsNamespace+"_pool_wait_count_total",
+		"The total number of server connections waited for.", poolLabels, nil)
+	poolWaitDurationDesc = prometheus.NewDesc(metricsNamespace+"_pool_wait_duration_seconds_total",
+		"The total time blocked waiting for a server connection.", poolLabels, nil)
+	poolMaxIdleClosedDesc = prometheus.NewDesc(metricsNamespace+"_pool_max_idle_closed_total",
+		"The total number of server connections closed due to MaxIdle.", poolLabels, nil)
+	poolMaxIdleTimeClosedDesc = prometheus.NewDesc(metricsNamespace+"_pool_max_idle_time_closed_total",
+		"The total number of server connections closed due to MaxIdletimeSecs.", poolLabels, nil)
+	poolMaxLifetimeClosedDesc = prometheus.NewDesc(metricsNamespace+"_pool_max_lifetime_closed_total",
+		"The total number of server connections closed due to MaxLifetimeSecs.", poolLabels, nil)
+	poolConnCreateFailedDesc = prometheus.NewDesc(metricsNamespace+"_pool_conn_create_failures_total",
+		"The total number of failed attempts to open a server connection.", poolLabels, nil)
+	poolResetFailedDesc = prometheus.NewDesc(metricsNamespace+"_pool_reset_failures_total",
+		"The total number of server connections closed due to a failed reset query.", poolLabels, nil)
+)
+
+func (pc *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolOpenDesc
+	ch <- poolInUseDesc
+	ch <- poolIdleDesc
+	ch <- poolWaitingDesc
+	ch <- poolWaitCountDesc
+	ch <- poolWaitDurationDesc
+	ch <- poolMaxIdleClosedDesc
+	ch <- poolMaxIdleTimeClosedDesc
+	ch <- poolMaxLifetimeClosedDesc
+	ch <- poolConnCreateFailedDesc
+	ch <- poolResetFailedDesc
+}
+
+func (pc *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	pools := pc.poolMgr.snapshot()
+	for key, p := range pools {
+		stats := p.Stats()
+		labels := []string{key.host, key.db, key.tenant}
+		ch <- prometheus.MustNewConstMetric(poolOpenDesc, prometheus.GaugeValue, float64(stats.OpenConnections), labels...)
+		ch <- prometheus.MustNewConstMetric(poolInUseDesc, prometheus.GaugeValue, float64(stats.InUse), labels...)
+		ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(stats.Idle), labels...)
+		ch <- prometheus.MustNewConstMetric(poolWaitingDesc, prometheus.GaugeValue, float64(stats.Waiting), labels...)
+		ch <- prometheus.MustNewConstMetric(poolWaitCountDesc, prometheus.CounterValue, float64(stats.WaitCount), labels...)
+		ch <- prometheus.MustNewConstMetric(poolWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds(), labels...)
+		ch <- prometheus.MustNewConstMetric(poolMaxIdleClosedDesc, prometheus.CounterValue, float64(stats.MaxIdleClosed), labels...)
+		ch <- prometheus.MustNewConstMetric(poolMaxIdleTimeClosedDesc, prometheus.CounterValue, float64(stats.MaxIdleTimeClosed), labels...)
+		ch <- prometheus.MustNewConstMetric(poolMaxLifetimeClosedDesc, prometheus.CounterValue, float64(stats.MaxLifetimeClosed), labels...)
+		ch <- prometheus.MustNewConstMetric(poolConnCreateFailedDesc, prometheus.CounterValue, float64(stats.ConnCreateFailed), labels...)
+		ch <- prometheus.MustNewConstMetric(poolResetFailedDesc, prometheus.CounterValue, float64(stats.ResetFailed), labels...)
+	}
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/carlmjohnson/be"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPoolCollector(t *testing.T) {
+	p, err := NewPool(genBasePoolConfig())
+	be.NilErr(t, err)
+	defer p.Close()
+
+	sc, err := p.AcquireConn()
+	be.NilErr(t, err)
+	defer p.ReleaseConn(sc)
+
+	pc := &poolCollector{poolMgr: &PoolManager{
+		pools: map[poolKey]*Pool{{host: "localhost:5432", db: "mattermost"}: p},
+	}}
+	be.Equal(t, 11, testutil.CollectAndCount(pc))
+
+	expected := `
+# HELP perseus_pool_in_use_connections The number of server connections currently in use.
+# TYPE perseus_pool_in_use_connections gauge
+perseus_pool_in_use_connections{db="mattermost",host="localhost:5432",tenant=""} 1
+`
+	be.NilErr(t, testutil.CollectAndCompare(pc, strings.NewReader(expected), "perseus_pool_in_use_connections"))
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// trackedParams are the session parameters which a client can set in its
+// startup message, or later with SET. They are applied to every server
+// conn the client acquires, since the client may get a different one each time.
+var trackedParams = map[string]bool{
+	"application_name":   true,
+	"client_encoding":    true,
+	"DateStyle":          true,
+	"IntervalStyle":      true,
+	"TimeZone":           true,
+	"extra_float_digits": true,
+}
+
+// relayedServerParams are the parameters reported by the server which are
+// relayed to clients on login. Drivers rely on some of them, like
+// standard_conforming_strings and integer_datetimes.
+var relayedServerParams = []string{
+	"server_version",
+	"server_encoding",
+	"client_encoding",
+	"application_name",
+	"DateStyle",
+	"IntervalStyle",
+	"integer_datetimes",
+	"standard_conforming_strings",
+	"TimeZone",
+}
+
+// sessionParams returns the tracked parameters out of the startup parameters.
+// Settings passed in the options parameter are included, but the
+// parameters given directly take precedence.
+func sessionParams(startup map[string]string) map[string]string {
+	params := make(map[string]string)
+	for _, src := range []map[string]string{parseOptions(startup["options"]), startup} {
+		for name, value := range src {
+			// Parameter names are case insensitive.
+			for tracked := range trackedParams {
+				if strings.EqualFold(name, tracked) {
+					params[tracked] = value
+				}
+			}
+		}
+	}
+	return params
+}
+
+// sessionState is the state of a session, as the SQL value of each
+// setting keyed by its name. It covers the search_path and the tracked params.
+type sessionState map[string]string
+
+// sessionStmts returns the statements which take a session from the current
+// state to the desired one, in a stable order. Settings which are not in the
+// desired state are reset. A nil current state means that it is not known,
+// so everything is set or reset.
+func sessionStmts(desired, current sessionState) []string {
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// The names come from trackedParams or are search_path,
+	// so they need no quoting.
+	var stmts []string
+	for _, name := range names {
+		if value, ok := current[name]; !ok || value != desired[name] {
+			stmts = append(stmts, fmt.Sprintf("SET %s TO %s", name, desired[name]))
+		}
+	}
+
+	var resets []string
+	for name := range trackedParams {
+		_, wanted := desired[name]
+		_, set := current[name]
+		if !wanted && (set || current == nil) {
+			resets = append(resets, "RESET "+name)
+		}
+	}
+	sort.Strings(resets)
+	return append(stmts, resets...)
+}
+
+// quoteLiteral quotes s as a string literal, the same way
+// quote_literal does in PostgreSQL.
+func quoteLiteral(s string) string {
+	lit := "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	if strings.Contains(s, `\`) {
+		lit = "E" + strings.ReplaceAll(lit, `\`, `\\`)
+	}
+	return lit
+}
+
+// parseSearchPath parses a comma separated list of schemas, in the same
+// way PostgreSQL parses search_path. Unquoted names are lower cased, and
+// double quoted names are taken as they are.
+func parseSearchPath(s string) ([]string, error) {
+	var schemas []string
+	rest := strings.TrimSpace(s)
+	for {
+		var name string
+		if strings.HasPrefix(rest, `"`) {
+			// Find the closing quote, skipping escaped ones.
+			end := 1
+			for {
+				i := strings.IndexByte(rest[end:], '"')
+				if i < 0 {
+					return nil, fmt.Errorf("unterminated quoted schema name in %q", s)
+				}
+				end += i + 1
+				if !strings.HasPrefix(rest[end:], `"`) {
+					break
+				}
+				end++
+			}
+			name = strings.ReplaceAll(rest[1:end-1], `""`, `"`)
+			rest = strings.TrimSpace(rest[end:])
+		} else {
+			i := strings.IndexByte(rest, ',')
+			if i < 0 {
+				i = len(rest)
+			}
+			name = strings.ToLower(strings.TrimSpace(rest[:i]))
+			if strings.ContainsAny(name, `" `) {
+				return nil, fmt.Errorf("invalid schema name %q in %q", name, s)
+			}
+			rest = rest[i:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty schema name in %q", s)
+		}
+		schemas = append(schemas, name)
+
+		if rest == "" {
+			return schemas, nil
+		}
+		if rest[0] != ',' {
+			return nil, fmt.Errorf("expected a comma after schema %q in %q", name, s)
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+}
+
+// sameSearchPath reports whether the schema in an auth row is the same search path as schemas.
+func sameSearchPath(rowSchema string, schemas []string) bool {
+	rowSchemas, err := parseSearchPath(rowSchema)
+	if err != nil || len(rowSchemas) != len(schemas) {
+		return false
+	}
+	for i := range schemas {
+		if rowSchemas[i] != schemas[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isSessionCommand reports whether the command tag is
+// from a command which changes the session state.
+func isSessionCommand(tag []byte) bool {
+	cmd, _, _ := strings.Cut(string(tag), " ")
+	switch cmd {
+	case "SET", "RESET", "DISCARD":
+		return true
+	}
+	return false
+}
+
+// dropsPreparedStmts reports whether the command tag is from
+// a command which deallocates all prepared statements.
+func dropsPreparedStmts(tag []byte) bool {
+	switch string(tag) {
+	case "DEALLOCATE ALL", "DISCARD ALL":
+		return true
+	}
+	return false
+}
+
+// resetState returns the state of a session after the reset query
+// has been run on it. Both DISCARD ALL and RESET ALL put every setting
+// back to its default. Nothing is known after any other query.
+func resetState(query string) sessionState {
+	switch normalizeCommand(query) {
+	case "DISCARD ALL", "RESET ALL":
+		return sessionState{}
+	}
+	return nil
+}
+
+// keepsPreparedStmts reports whether the prepared statements are
+// known to survive the reset query. Only RESET ALL leaves them.
+func keepsPreparedStmts(query string) bool {
+	return normalizeCommand(query) == "RESET ALL"
+}
+
+// normalizeCommand upper cases a single command, with its
+// words separated by a single space and no trailing semicolon.
+func normalizeCommand(query string) string {
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+	return strings.ToUpper(strings.Join(strings.Fields(query), " "))
+}
+
+// formatSearchPath returns the schemas as the value of search_path,
+// each quoted as an identifier.
+func formatSearchPath(schemas []string) string {
+	quoted := make([]string, len(schemas))
+	for i, schema := range schemas {
+		quoted[i] = quoteIdentifier(schema)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func quoteIdentifier(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// parseOptions parses the options startup parameter, which holds command
+// line style arguments for the server, like "-c search_path=a,b". Only
+// settings passed with -c or --name=value are returned. Spaces inside
+// a value are escaped with a backslash.
+func parseOptions(options string) map[string]string {
+	var (
+		args []string
+		arg  strings.Builder
+	)
+	escaped := false
+	for _, r := range options {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if arg.Len() > 0 {
+				args = append(args, arg.String())
+				arg.Reset()
+			}
+		default:
+			arg.WriteRune(r)
+		}
+	}
+	if arg.Len() > 0 {
+		args = append(args, arg.String())
+	}
+
+	settings := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		var setting string
+		switch {
+		case args[i] == "-c" && i+1 < len(args):
+			i++
+			setting = args[i]
+		case strings.HasPrefix(args[i], "-c"):
+			setting = args[i][2:]
+		case strings.HasPrefix(args[i], "--"):
+			setting = args[i][2:]
+		default:
+			continue
+		}
+		if name, value, ok := strings.Cut(setting, "="); ok {
+			// Dashes are allowed in place of underscores.
+			settings[strings.ReplaceAll(name, "-", "_")] = value
+		}
+	}
+	return settings
+}
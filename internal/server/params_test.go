@@ -0,0 +1,111 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/carlmjohnson/be"
+)
+
+func TestSessionStmts(t *testing.T) {
+	params := sessionParams(map[string]string{
+		"user":             "mmuser",
+		"database":         "mmdb",
+		"application_name": "it's",
+		"TimeZone":         `Europe\Berlin`,
+	})
+	desired := sessionState{"search_path": formatSearchPath([]string{"tenant1"})}
+	for name, value := range params {
+		desired[name] = quoteLiteral(value)
+	}
+
+	// A new conn only needs what the client asked for.
+	be.AllEqual(t, []string{
+		`SET TimeZone TO E'Europe\\Berlin'`,
+		`SET application_name TO 'it''s'`,
+		`SET search_path TO "tenant1"`,
+	}, sessionStmts(desired, sessionState{}))
+
+	// Nothing is sent when the state matches.
+	be.Equal(t, 0, len(sessionStmts(desired, desired)))
+
+	// Settings left by the previous client are reset.
+	current := sessionState{
+		"search_path":      `"tenant2"`,
+		"application_name": `'it''s'`,
+		"TimeZone":         `E'Europe\\Berlin'`,
+		"DateStyle":        `'ISO'`,
+	}
+	be.AllEqual(t, []string{
+		`SET search_path TO "tenant1"`,
+		`RESET DateStyle`,
+	}, sessionStmts(desired, current))
+
+	// Everything else is reset when the state is unknown.
+	stmts := sessionStmts(sessionState{"search_path": `"tenant1"`}, nil)
+	be.Equal(t, 1+len(trackedParams), len(stmts))
+}
+
+func TestResetState(t *testing.T) {
+	be.Equal(t, "DISCARD ALL", resetQuery("", PoolModeSession))
+	be.Equal(t, "", resetQuery("", PoolModeTransaction))
+	be.Equal(t, "", resetQuery("none", PoolModeSession))
+	be.Equal(t, "RESET ALL", resetQuery("RESET ALL", PoolModeTransaction))
+
+	be.True(t, resetState("DISCARD ALL") != nil)
+	be.True(t, resetState(" reset  all; ") != nil)
+	be.Equal(t, 0, len(resetState("RESET ALL")))
+	// Nothing is known about the session after other queries.
+	be.True(t, resetState("SELECT pg_advisory_unlock_all()") == nil)
+}
+
+func TestPoolServerParams(t *testing.T) {
+	p, err := NewPool(genBasePoolConfig())
+	be.NilErr(t, err)
+	defer p.Close()
+
+	params, err := p.ServerParams()
+	be.NilErr(t, err)
+	be.Equal(t, "15.1", params["server_version"])
+	be.Equal(t, 1, len(params))
+	// The conn used to capture them is kept around.
+	be.Equal(t, 1, p.Stats().Idle)
+}
+
+func TestParseSearchPath(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{"tenant1", []string{"tenant1"}},
+		{"Tenant1, public", []string{"tenant1", "public"}},
+		{`"Tenant1","we""ird", "$user"`, []string{"Tenant1", `we"ird`, "$user"}},
+		{`x';DROP`, []string{`x';drop`}},
+	} {
+		got, err := parseSearchPath(tc.in)
+		be.NilErr(t, err)
+		be.AllEqual(t, tc.want, got)
+	}
+
+	for _, in := range []string{"", "a,,b", `"unterminated`, `"a" b`, "x'; DROP TABLE users; --"} {
+		_, err := parseSearchPath(in)
+		be.Nonzero(t, err)
+	}
+
+	be.Equal(t, `"x'; drop table users; --", "we""ird"`,
+		formatSearchPath([]string{`x'; drop table users; --`, `we"ird`}))
+}
+
+func TestParseOptions(t *testing.T) {
+	opts := parseOptions(`-c search_path=tenant1,public --application-name=my\ app -cTimeZone=UTC -x`)
+	be.Equal(t, "tenant1,public", opts["search_path"])
+	be.Equal(t, "my app", opts["application_name"])
+	be.Equal(t, "UTC", opts["TimeZone"])
+	be.Equal(t, 3, len(opts))
+
+	params := sessionParams(map[string]string{
+		"options":          "-c timezone=UTC -c application_name=opt",
+		"application_name": "direct",
+	})
+	be.Equal(t, "UTC", params["TimeZone"])
+	be.Equal(t, "direct", params["application_name"])
+}
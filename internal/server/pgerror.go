@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// The SQLSTATE codes of the errors reported by Perseus itself.
+// See https://www.postgresql.org/docs/current/errcodes-appendix.html.
+const (
+	codeCannotConnect        = "08001" // sqlclient_unable_to_establish_sqlconnection
+	codeRejectedConnection   = "08004" // sqlserver_rejected_establishment_of_sqlconnection
+	codeConnectionFailure    = "08006"
+	codeProtocolViolation    = "08P01"
+	codeFeatureNotSupported  = "0A000"
+	codeInvalidAuthorization = "28000"
+	codeInvalidPassword      = "28P01"
+	codeInvalidCatalogName   = "3D000"
+	codeInvalidSchemaName    = "3F000"
+	codeSyntaxError          = "42601"
+	codeTooManyConnections   = "53300"
+	codeAdminShutdown        = "57P01"
+	codeCannotConnectNow     = "57P03"
+	codeConfigFileError      = "F0000"
+	codeInternalError        = "XX000"
+)
+
+const (
+	severityError = "ERROR"
+	severityFatal = "FATAL"
+)
+
+// pgError is an error which is reported to the client in an ErrorResponse.
+// After a FATAL error, the client conn is closed.
+type pgError struct {
+	severity string
+	code     string
+	message  string
+}
+
+func (e *pgError) Error() string {
+	return e.message
+}
+
+func (e *pgError) response() *pgproto3.ErrorResponse {
+	return &pgproto3.ErrorResponse{
+		Severity:            e.severity,
+		SeverityUnlocalized: e.severity,
+		Code:                e.code,
+		Message:             e.message,
+	}
+}
+
+// fatalf returns a FATAL error with the given code.
+func fatalf(code, format string, args ...any) *pgError {
+	return &pgError{severity: severityFatal, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// errorf returns an ERROR with the given code. The session goes on after it.
+func errorf(code, format string, args ...any) *pgError {
+	return &pgError{severity: severityError, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// errorCode returns the SQLSTATE code reported to the client for err.
+// The errors of the destination keep their code. Errors which are not
+// known get the fallback code.
+func errorCode(err error, fallback string) string {
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.As(err, &pgErr):
+		return pgErr.Code
+	case errors.Is(err, ErrCredentialsNotFound), errors.Is(err, ErrPasswordMismatch):
+		return codeInvalidPassword
+	case errors.Is(err, ErrLockedOut):
+		return codeInvalidAuthorization
+	case errors.Is(err, ErrTooManyVerifies),
+		errors.Is(err, ErrQueryWaitTimeout),
+		errors.Is(err, ErrWaitQueueFull):
+		return codeTooManyConnections
+	case errors.Is(err, ErrPoolClosed):
+		return codeAdminShutdown
+	case errors.Is(err, ErrConnExpired):
+		return codeConnectionFailure
+	case errors.Is(err, ErrServerTLSVerify):
+		return codeCannotConnect
+	case errors.Is(err, ErrDestinationAuth):
+		return codeRejectedConnection
+	}
+	return fallback
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/carlmjohnson/be"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestErrorCode(t *testing.T) {
+	be.Equal(t, codeInvalidPassword, errorCode(ErrPasswordMismatch, codeInternalError))
+	be.Equal(t, codeTooManyConnections, errorCode(fmt.Errorf("error while acquiring conn: %w", ErrWaitQueueFull), codeInternalError))
+	be.Equal(t, codeInternalError, errorCode(fmt.Errorf("unknown"), codeInternalError))
+
+	// The errors of the destination keep their code.
+	err := fmt.Errorf("error while connecting: %w", &pgconn.PgError{Code: "3D000"})
+	be.Equal(t, "3D000", errorCode(err, codeCannotConnect))
+
+	// Except when the destination rejects the credentials of Perseus,
+	// which are not the client's.
+	err = fmt.Errorf("%w h/db: %v", ErrDestinationAuth, &pgconn.PgError{Code: "28P01"})
+	be.Equal(t, codeRejectedConnection, errorCode(err, codeCannotConnect))
+	be.True(t, isAuthError(&pgconn.PgError{Code: "28000"}))
+
+	resp := fatalf(codeInvalidCatalogName, "empty database name received in params").response()
+	be.Equal(t, "FATAL", resp.Severity)
+	be.Equal(t, codeInvalidCatalogName, resp.Code)
+}
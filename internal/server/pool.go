@@ -3,7 +3,7 @@ package server
 import (
 	"context"
 	"errors"
-	"log"
+	"log/slog"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,7 +12,7 @@ import (
 // Pool is a copied implementation of just the connection pooling
 // logic from database/sql.
 type Pool struct {
-	logger    *log.Logger
+	logger    *slog.Logger
 	spawnConn func(ctx context.Context) (Conner, error)
 
 	mu           sync.Mutex    // protects following fields
@@ -29,6 +29,18 @@ type Pool struct {
 	openerCh chan struct{}
 	closed   bool
 
+	// While paused, no connections are handed out. resumeCh
+	// is closed when the pool is resumed or closed.
+	paused        bool
+	resumeCh      chan struct{}
+	pausedWaiters int // number of requests waiting for the pool to be resumed
+	// generation is bumped on reconnect. Connections from
+	// an older generation are closed when released.
+	generation uint64
+	// serverParams are the relayed parameters reported by the
+	// first server conn. It is nil until a conn is opened.
+	serverParams map[string]string
+
 	maxIdle           int           // zero means defaultMaxIdleConns; negative means 0
 	maxOpen           int           // <= 0 means unlimited
 	maxLifetime       time.Duration // maximum amount of time a connection may be reused
@@ -36,11 +48,20 @@ type Pool struct {
 	connCreateTimeout time.Duration
 	connCloseTimeout  time.Duration
 	schemaExecTimeout time.Duration
+	queryWaitTimeout  time.Duration // <= 0 means wait forever
+	maxWaitQueue      int           // <= 0 means unlimited
+	resetQuery        string        // empty means conns are not reset
+	sessionResetQuery string        // for conns of session mode clients
+	maxPreparedStmts  int           // maximum number of statements prepared on a conn
 	cleanerCh         chan struct{}
 	waitCount         int64        // Total number of connections waited for.
 	maxIdleClosed     int64        // Total number of connections closed due to idle count.
 	maxIdleTimeClosed int64        // Total number of connections closed due to idle time.
 	maxLifetimeClosed int64        // Total number of connections closed due to max connection lifetime limit.
+	waitTimeoutCount  int64        // Total number of waits which timed out.
+	waitRejectedCount int64        // Total number of requests rejected due to a full wait queue.
+	connCreateFailed  int64        // Total number of failed attempts to open a connection.
+	resetFailed       int64        // Total number of connections closed due to a failed reset.
 	waitDuration      atomic.Int64 // Total time waited for new connections.
 
 	stop func() // stop cancels the connection opener.
@@ -48,7 +69,7 @@ type Pool struct {
 
 type PoolConfig struct {
 	SpawnConn func(ctx context.Context) (Conner, error)
-	Logger    *log.Logger
+	Logger    *slog.Logger
 
 	MaxIdle           int
 	MaxOpen           int
@@ -57,6 +78,16 @@ type PoolConfig struct {
 	ConnCreateTimeout time.Duration
 	ConnCloseTimeout  time.Duration
 	SchemaExecTimeout time.Duration
+	QueryWaitTimeout  time.Duration
+	MaxWaitQueue      int
+	// ResetQuery is run on a conn when it is released. Empty means none.
+	ResetQuery string
+	// SessionResetQuery replaces ResetQuery for the conns
+	// released by session mode clients.
+	SessionResetQuery string
+	// MaxPreparedStmts is the number of statements kept
+	// prepared on a conn. It defaults to defaultMaxPreparedStmts.
+	MaxPreparedStmts int
 }
 
 // This is the size of the connectionOpener request chan (Pool.openerCh).
@@ -69,6 +100,12 @@ var connectionRequestQueueSize = 1000000
 var (
 	ErrPoolClosed  = errors.New("pool is closed")
 	ErrConnExpired = errors.New("connection expired")
+	// ErrQueryWaitTimeout is returned when no connection became
+	// available within the query wait timeout.
+	ErrQueryWaitTimeout = errors.New("timed out waiting for a server connection")
+	// ErrWaitQueueFull is returned when too many requests are
+	// already waiting for a connection.
+	ErrWaitQueueFull = errors.New("too many clients waiting for a server connection")
 )
 
 func NewPool(cfg PoolConfig) (*Pool, error) {
@@ -86,6 +123,11 @@ func NewPool(cfg PoolConfig) (*Pool, error) {
 		connCreateTimeout: cfg.ConnCreateTimeout,
 		connCloseTimeout:  cfg.ConnCloseTimeout,
 		schemaExecTimeout: cfg.SchemaExecTimeout,
+		queryWaitTimeout:  cfg.QueryWaitTimeout,
+		maxWaitQueue:      cfg.MaxWaitQueue,
+		resetQuery:        cfg.ResetQuery,
+		sessionResetQuery: cfg.SessionResetQuery,
+		maxPreparedStmts:  cfg.MaxPreparedStmts,
 
 		openerCh:     make(chan struct{}, connectionRequestQueueSize),
 		connRequests: make(map[uint64]chan connRequest),
@@ -105,6 +147,17 @@ type connRequest struct {
 	err  error
 }
 
+// spawnWithTimeout opens a new connection with spawnConn,
+// giving up after timeout, unless it is zero.
+func spawnWithTimeout(ctx context.Context, spawnConn func(ctx context.Context) (Conner, error), timeout time.Duration) (Conner, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return spawnConn(ctx)
+}
+
 // Runs in a separate goroutine, opens new connections when requested.
 func (p *Pool) connectionOpener(ctx context.Context) {
 	for {
@@ -122,7 +175,10 @@ func (p *Pool) openNewConnection(ctx context.Context) {
 	// maybeOpenNewConnections has already executed p.numOpen++ before it sent
 	// on p.openerCh. This function must execute p.numOpen-- if the
 	// connection fails or is closed before returning.
-	conn, err := p.spawnConn(ctx)
+	p.mu.Lock()
+	spawnConn, generation, timeout := p.spawnConn, p.generation, p.connCreateTimeout
+	p.mu.Unlock()
+	conn, err := spawnWithTimeout(ctx, spawnConn, timeout)
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	if p.closed {
@@ -136,16 +192,21 @@ func (p *Pool) openNewConnection(ctx context.Context) {
 	}
 	if err != nil {
 		p.numOpen--
+		p.connCreateFailed++
 		p.putConnDBLocked(nil, err)
 		// Deviation from database/sql. We don't want to open a new connection
 		// if creating one already failed.
 		return
 	}
+	p.captureParamsLocked(conn)
 	sc := &ServerConn{
 		pool:       p,
 		createdAt:  time.Now(),
 		returnedAt: time.Now(),
 		conn:       conn,
+		generation: generation,
+		state:      sessionState{},
+		prepared:   newStmtCache(p.maxPreparedStmts),
 	}
 	if !p.putConnDBLocked(sc, err) {
 		p.numOpen--
@@ -170,6 +231,11 @@ func (p *Pool) putConnDBLocked(sc *ServerConn, err error) bool {
 	if p.maxOpen > 0 && p.numOpen > p.maxOpen {
 		return false
 	}
+	// A paused pool keeps no idle conns, and the requests
+	// made before it was paused wait until it is resumed.
+	if p.paused {
+		return false
+	}
 	if c := len(p.connRequests); c > 0 {
 		var req chan connRequest
 		var reqKey uint64
@@ -217,6 +283,10 @@ func (p *Pool) shortestIdleTimeLocked() time.Duration {
 // If there are connRequests and the connection limit hasn't been reached,
 // then tell the connectionOpener to open new connections.
 func (p *Pool) maybeOpenNewConnections() {
+	// The requests are served once the pool is resumed.
+	if p.paused {
+		return
+	}
 	numRequests := len(p.connRequests)
 	if p.maxOpen > 0 {
 		numCanOpen := p.maxOpen - p.numOpen
@@ -234,8 +304,43 @@ func (p *Pool) maybeOpenNewConnections() {
 	}
 }
 
-// putConn adds a connection to the db's free pool.
+// ReleaseConn returns a connection to the pool, after running the reset
+// query on it to clear the session state left by its user. A connection
+// which fails to be reset is closed instead.
 func (p *Pool) ReleaseConn(sc *ServerConn) {
+	p.mu.Lock()
+	resetQuery := p.resetQuery
+	p.mu.Unlock()
+	p.resetAndPutConn(sc, resetQuery)
+}
+
+// ReleaseSessionConn is ReleaseConn for the conn of a session mode
+// client, which is more likely to have left session state behind.
+func (p *Pool) ReleaseSessionConn(sc *ServerConn) {
+	p.mu.Lock()
+	resetQuery := p.sessionResetQuery
+	p.mu.Unlock()
+	p.resetAndPutConn(sc, resetQuery)
+}
+
+func (p *Pool) resetAndPutConn(sc *ServerConn, resetQuery string) {
+	var err error
+	if resetQuery != "" {
+		if err = sc.Exec(resetQuery); err != nil {
+			p.logger.Warn("Error resetting server connection, closing it", "backend_pid", sc.PID(), "err", err)
+		} else {
+			sc.state = resetState(resetQuery)
+			if !keepsPreparedStmts(resetQuery) {
+				sc.prepared.clear()
+			}
+		}
+	}
+	p.putConn(sc, err)
+}
+
+// putConn adds a connection to the db's free pool.
+// err is non-nil if the connection is known to be bad.
+func (p *Pool) putConn(sc *ServerConn, err error) {
 	p.mu.Lock()
 	if !sc.inUse {
 		p.mu.Unlock()
@@ -243,9 +348,14 @@ func (p *Pool) ReleaseConn(sc *ServerConn) {
 	}
 
 	var closeConn bool
-	if sc.expired(p.maxLifetime) {
+	if err != nil {
+		p.resetFailed++
+		closeConn = true
+	} else if sc.expired(p.maxLifetime) {
 		p.maxLifetimeClosed++
 		closeConn = true
+	} else if sc.generation != p.generation {
+		closeConn = true
 	}
 	sc.inUse = false
 	sc.returnedAt = time.Now()
@@ -282,10 +392,17 @@ const (
 )
 
 func (p *Pool) AcquireConn() (*ServerConn, error) {
+	return p.AcquireConnPrefer(nil)
+}
+
+// AcquireConnPrefer is like AcquireConn, but prefers an idle conn for which
+// prefer returns true, such as one which already has the right session state.
+// prefer is called with p.mu held.
+func (p *Pool) AcquireConnPrefer(prefer func(sc *ServerConn) bool) (*ServerConn, error) {
 	// The first time might run into an expired connection,
 	// so we give a second chance.
 	for i := 0; i < 2; i++ {
-		sc, err := p.conn(cachedOrNewConn)
+		sc, err := p.conn(cachedOrNewConn, prefer)
 		// only return if connection is not expired, then probably
 		// something else has happened
 		if err == nil || !errors.Is(err, ErrConnExpired) {
@@ -293,25 +410,51 @@ func (p *Pool) AcquireConn() (*ServerConn, error) {
 		}
 	}
 
-	return p.conn(alwaysNewConn)
+	return p.conn(alwaysNewConn, nil)
 }
 
 // conn returns a newly-opened or cached *ServerConn.
-func (p *Pool) conn(strategy connReuseStrategy) (*ServerConn, error) {
+func (p *Pool) conn(strategy connReuseStrategy, prefer func(sc *ServerConn) bool) (*ServerConn, error) {
+	waitStart := time.Now()
 	p.mu.Lock()
 	if p.closed {
 		p.mu.Unlock()
 		return nil, ErrPoolClosed
 	}
 
+	for p.paused {
+		if err := p.waitResumeLocked(waitStart); err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+	}
+
 	lifetime := p.maxLifetime
 
 	// Prefer a free connection, if possible.
 	last := len(p.freeConn) - 1
 	if strategy == cachedOrNewConn && last >= 0 {
 		// Reuse the lowest idle time connection so we can close
-		// connections which remain idle as soon as possible.
-		conn := p.freeConn[last]
+		// connections which remain idle as soon as possible,
+		// unless there is a preferred one.
+		i := last
+		if prefer != nil {
+			for j := last; j >= 0; j-- {
+				if prefer(p.freeConn[j]) {
+					i = j
+					break
+				}
+			}
+		}
+		conn := p.freeConn[i]
+		// Use slow delete as order is required to ensure
+		// connections are reused least idle time first.
+		copy(p.freeConn[i:], p.freeConn[i+1:])
+		p.freeConn[last] = nil
 		p.freeConn = p.freeConn[:last]
 		conn.inUse = true
 		if conn.expired(lifetime) {
@@ -330,18 +473,56 @@ func (p *Pool) conn(strategy connReuseStrategy) (*ServerConn, error) {
 	// Out of free connections or we were asked not to use one. If we're not
 	// allowed to open any more connections, make a request and wait.
 	if p.maxOpen > 0 && p.numOpen >= p.maxOpen {
+		if p.maxWaitQueue > 0 && len(p.connRequests) >= p.maxWaitQueue {
+			p.waitRejectedCount++
+			p.mu.Unlock()
+			return nil, ErrWaitQueueFull
+		}
+
 		// Make the connRequest channel. It's buffered so that the
 		// connectionOpener doesn't block while waiting for the req to be read.
 		req := make(chan connRequest, 1)
 		reqKey := p.nextRequestKeyLocked()
 		p.connRequests[reqKey] = req
 		p.waitCount++
+		var timeout <-chan time.Time
+		if p.queryWaitTimeout > 0 {
+			// Time spent waiting on a paused pool counts towards the timeout.
+			t := time.NewTimer(p.queryWaitTimeout - time.Since(waitStart))
+			defer t.Stop()
+			timeout = t.C
+		}
 		p.mu.Unlock()
 
-		waitStart := time.Now()
+		reqStart := time.Now()
+
+		var (
+			ret connRequest
+			ok  bool
+		)
+		select {
+		case <-timeout:
+			// Remove the connection request and ensure no value has been sent
+			// on it after removing.
+			p.mu.Lock()
+			delete(p.connRequests, reqKey)
+			p.waitTimeoutCount++
+			p.mu.Unlock()
 
-		ret, ok := <-req
-		p.waitDuration.Add(int64(time.Since(waitStart)))
+			p.waitDuration.Add(int64(time.Since(reqStart)))
+
+			select {
+			default:
+			case ret, ok := <-req:
+				if ok && ret.conn != nil {
+					// The conn was reset by whoever handed it over.
+					p.putConn(ret.conn, nil)
+				}
+			}
+			return nil, ErrQueryWaitTimeout
+		case ret, ok = <-req:
+			p.waitDuration.Add(int64(time.Since(reqStart)))
+		}
 
 		if !ok {
 			return nil, ErrPoolClosed
@@ -367,28 +548,179 @@ func (p *Pool) conn(strategy connReuseStrategy) (*ServerConn, error) {
 	}
 
 	p.numOpen++ // optimistically
+	spawnConn, generation, timeout := p.spawnConn, p.generation, p.connCreateTimeout
 	p.mu.Unlock()
-	conn, err := p.spawnConn(context.Background())
+	conn, err := spawnWithTimeout(context.Background(), spawnConn, timeout)
 	if err != nil {
 		p.mu.Lock()
 		p.numOpen-- // correct for earlier optimism
+		p.connCreateFailed++
 		// Deviation from database/sql. We don't want to open a new connection
 		// if creating one already failed.
 		p.mu.Unlock()
 		return nil, err
 	}
 	p.mu.Lock()
+	p.captureParamsLocked(conn)
 	sc := &ServerConn{
 		pool:       p,
 		createdAt:  time.Now(),
 		returnedAt: time.Now(),
 		conn:       conn,
 		inUse:      true,
+		generation: generation,
+		state:      sessionState{},
+		prepared:   newStmtCache(p.maxPreparedStmts),
 	}
 	p.mu.Unlock()
 	return sc, nil
 }
 
+// captureParamsLocked remembers the parameters reported by the
+// server, if they were not captured from an earlier conn.
+func (p *Pool) captureParamsLocked(conn Conner) {
+	if p.serverParams != nil {
+		return
+	}
+	p.serverParams = make(map[string]string)
+	for _, name := range relayedServerParams {
+		if value := conn.ParameterStatus(name); value != "" {
+			p.serverParams[name] = value
+		}
+	}
+}
+
+// ServerParams returns the parameters reported by the server, which are
+// relayed to clients on login. A conn is acquired to capture them if none
+// has been opened yet. The returned map must not be modified.
+func (p *Pool) ServerParams() (map[string]string, error) {
+	p.mu.Lock()
+	params := p.serverParams
+	p.mu.Unlock()
+	if params != nil {
+		return params, nil
+	}
+
+	sc, err := p.AcquireConn()
+	if err != nil {
+		return nil, err
+	}
+	// The conn was not used, so there is nothing to reset.
+	p.putConn(sc, nil)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.serverParams, nil
+}
+
+// waitResumeLocked waits for a paused pool to be resumed, for up to the
+// query wait timeout since waitStart. p.mu must be held. It is unlocked
+// while waiting, and locked again before returning.
+func (p *Pool) waitResumeLocked(waitStart time.Time) error {
+	if p.maxWaitQueue > 0 && len(p.connRequests)+p.pausedWaiters >= p.maxWaitQueue {
+		p.waitRejectedCount++
+		return ErrWaitQueueFull
+	}
+
+	var timeout <-chan time.Time
+	if p.queryWaitTimeout > 0 {
+		t := time.NewTimer(p.queryWaitTimeout - time.Since(waitStart))
+		defer t.Stop()
+		timeout = t.C
+	}
+	resumeCh := p.resumeCh
+	p.pausedWaiters++
+	p.waitCount++
+	p.mu.Unlock()
+
+	pauseStart := time.Now()
+	var err error
+	select {
+	case <-resumeCh:
+	case <-timeout:
+		err = ErrQueryWaitTimeout
+	}
+	p.waitDuration.Add(int64(time.Since(pauseStart)))
+
+	p.mu.Lock()
+	p.pausedWaiters--
+	if err != nil {
+		p.waitTimeoutCount++
+	}
+	return err
+}
+
+// Pause stops the pool from handing out connections. AcquireConn waits
+// until the pool is resumed, subject to the query wait timeout, and so
+// do the requests which were already waiting for a connection.
+// Idle connections are closed. Connections in use are left alone,
+// and are closed when they are released.
+func (p *Pool) Pause() {
+	p.mu.Lock()
+	if p.closed || p.paused {
+		p.mu.Unlock()
+		return
+	}
+	p.paused = true
+	p.resumeCh = make(chan struct{})
+	closing := p.freeConn
+	p.freeConn = nil
+	p.mu.Unlock()
+
+	for _, sc := range closing {
+		sc.Close()
+	}
+}
+
+// Resume lets a paused pool hand out connections again.
+func (p *Pool) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || !p.paused {
+		return
+	}
+	p.paused = false
+	close(p.resumeCh)
+	// Serve the requests which were waiting for a conn before the pause.
+	p.maybeOpenNewConnections()
+}
+
+// Reconnect closes the idle connections, and marks the connections in use
+// to be closed when they are released. If spawnConn is not nil, it is used
+// to open connections from now on.
+func (p *Pool) Reconnect(spawnConn func(ctx context.Context) (Conner, error)) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	if spawnConn != nil {
+		p.spawnConn = spawnConn
+	}
+	p.generation++
+	closing := p.freeConn
+	p.freeConn = nil
+	p.mu.Unlock()
+
+	for _, sc := range closing {
+		sc.Close()
+	}
+}
+
+// idleConnInfos returns the details of the idle connections. They are
+// read under the lock, since an idle connection can be closed anytime.
+func (p *Pool) idleConnInfos() []serverConnInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	infos := make([]serverConnInfo, 0, len(p.freeConn))
+	for _, sc := range p.freeConn {
+		if info, ok := sc.info(); ok {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
 // nextRequestKeyLocked returns the next connection request key.
 // It is assumed that nextRequest will not overflow.
 func (p *Pool) nextRequestKeyLocked() uint64 {
@@ -413,6 +745,9 @@ func (p *Pool) Close() error {
 	}
 	p.freeConn = nil
 	p.closed = true
+	if p.paused {
+		close(p.resumeCh)
+	}
 	for _, req := range p.connRequests {
 		close(req)
 	}
@@ -555,6 +890,27 @@ func (p *Pool) Reload(new PoolConfig) {
 	if p.maxIdleTime != new.MaxIdleTime {
 		p.SetConnMaxIdleTime(new.MaxIdleTime)
 	}
+
+	p.SetQueryWait(new.QueryWaitTimeout, new.MaxWaitQueue)
+
+	p.mu.Lock()
+	p.connCreateTimeout = new.ConnCreateTimeout
+	p.resetQuery = new.ResetQuery
+	p.sessionResetQuery = new.SessionResetQuery
+	p.maxPreparedStmts = new.MaxPreparedStmts
+	p.mu.Unlock()
+}
+
+// SetQueryWait sets the maximum time to wait for a connection when
+// all are in use, and the maximum number of requests allowed to wait.
+//
+// If timeout <= 0, requests wait forever. If maxQueue <= 0, there is
+// no limit on the number of waiting requests.
+func (p *Pool) SetQueryWait(timeout time.Duration, maxQueue int) {
+	p.mu.Lock()
+	p.queryWaitTimeout = timeout
+	p.maxWaitQueue = maxQueue
+	p.mu.Unlock()
 }
 
 // SetMaxIdleConns sets the maximum number of connections in the idle
@@ -568,7 +924,7 @@ func (p *Pool) Reload(new PoolConfig) {
 // The default max idle connections is currently 2. This may change in
 // a future release.
 func (p *Pool) SetMaxIdleConns(n int) {
-	p.logger.Println("setting max idle")
+	p.logger.Debug("Setting max idle", "max_idle", n)
 	p.mu.Lock()
 	if n > 0 {
 		p.maxIdle = n
@@ -665,9 +1021,11 @@ type DBStats struct {
 	MaxOpenConnections int // Maximum number of open connections to the database.
 
 	// Pool Status
-	OpenConnections int // The number of established connections both in use and idle.
-	InUse           int // The number of connections currently in use.
-	Idle            int // The number of idle connections.
+	OpenConnections int  // The number of established connections both in use and idle.
+	InUse           int  // The number of connections currently in use.
+	Idle            int  // The number of idle connections.
+	Waiting         int  // The number of requests currently waiting for a connection.
+	Paused          bool // Whether the pool is paused.
 
 	// Counters
 	WaitCount         int64         // The total number of connections waited for.
@@ -675,6 +1033,10 @@ type DBStats struct {
 	MaxIdleClosed     int64         // The total number of connections closed due to SetMaxIdleConns.
 	MaxIdleTimeClosed int64         // The total number of connections closed due to SetConnMaxIdleTime.
 	MaxLifetimeClosed int64         // The total number of connections closed due to SetConnMaxLifetime.
+	WaitTimeoutCount  int64         // The total number of waits which timed out.
+	WaitRejectedCount int64         // The total number of requests rejected due to a full wait queue.
+	ConnCreateFailed  int64         // The total number of failed attempts to open a connection.
+	ResetFailed       int64         // The total number of connections closed due to a failed reset.
 }
 
 // Stats returns database statistics.
@@ -688,12 +1050,18 @@ func (p *Pool) Stats() DBStats {
 		Idle:            len(p.freeConn),
 		OpenConnections: p.numOpen,
 		InUse:           p.numOpen - len(p.freeConn),
+		Waiting:         len(p.connRequests) + p.pausedWaiters,
+		Paused:          p.paused,
 
 		WaitCount:         p.waitCount,
 		WaitDuration:      time.Duration(p.waitDuration.Load()),
 		MaxIdleClosed:     p.maxIdleClosed,
 		MaxIdleTimeClosed: p.maxIdleTimeClosed,
 		MaxLifetimeClosed: p.maxLifetimeClosed,
+		WaitTimeoutCount:  p.waitTimeoutCount,
+		WaitRejectedCount: p.waitRejectedCount,
+		ConnCreateFailed:  p.connCreateFailed,
+		ResetFailed:       p.resetFailed,
 	}
 	return stats
 }
@@ -2,7 +2,8 @@ package server
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
 	"net"
 	"sync"
 	"testing"
@@ -57,12 +58,237 @@ func TestPoolSpike(t *testing.T) {
 	be.NilErr(rt, p.Close())
 }
 
+func TestPoolQueryWait(t *testing.T) {
+	cfg := genBasePoolConfig()
+	cfg.QueryWaitTimeout = 20 * time.Millisecond
+	cfg.MaxWaitQueue = 1
+
+	p, err := NewPool(cfg)
+	be.NilErr(t, err)
+	defer p.Close()
+
+	sc, err := p.AcquireConn()
+	be.NilErr(t, err)
+
+	// The first waiter times out.
+	_, err = p.AcquireConn()
+	be.True(t, errors.Is(err, ErrQueryWaitTimeout))
+
+	// While one waiter is queued, the next is rejected.
+	errCh := make(chan error, 1)
+	go func() {
+		sc, err := p.AcquireConn()
+		if err == nil {
+			p.ReleaseConn(sc)
+		}
+		errCh <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	_, err = p.AcquireConn()
+	be.True(t, errors.Is(err, ErrWaitQueueFull))
+
+	// Releasing the conn satisfies the queued waiter.
+	p.ReleaseConn(sc)
+	be.NilErr(t, <-errCh)
+
+	stats := p.Stats()
+	be.Equal(t, int64(1), stats.WaitTimeoutCount)
+	be.Equal(t, int64(1), stats.WaitRejectedCount)
+	be.Equal(t, 1, stats.Idle)
+}
+
+func TestPoolPause(t *testing.T) {
+	cfg := genBasePoolConfig()
+	cfg.MaxOpen = 2
+	cfg.MaxIdle = 2
+	cfg.QueryWaitTimeout = 20 * time.Millisecond
+
+	p, err := NewPool(cfg)
+	be.NilErr(t, err)
+	defer p.Close()
+
+	idle, err := p.AcquireConn()
+	be.NilErr(t, err)
+	inUse, err := p.AcquireConn()
+	be.NilErr(t, err)
+	p.ReleaseConn(idle)
+
+	// Pausing closes the idle conn and leaves the one in use.
+	p.Pause()
+	stats := p.Stats()
+	be.True(t, stats.Paused)
+	be.Equal(t, 0, stats.Idle)
+	be.Equal(t, 1, stats.InUse)
+
+	// New requests wait until the pool is resumed.
+	_, err = p.AcquireConn()
+	be.True(t, errors.Is(err, ErrQueryWaitTimeout))
+
+	errCh := make(chan error, 1)
+	go func() {
+		sc, err := p.AcquireConn()
+		if err == nil {
+			p.ReleaseConn(sc)
+		}
+		errCh <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	be.Equal(t, 1, p.Stats().Waiting)
+
+	// A conn released while paused is closed.
+	p.ReleaseConn(inUse)
+	be.Equal(t, 0, p.Stats().OpenConnections)
+
+	p.Resume()
+	be.NilErr(t, <-errCh)
+	be.Equal(t, 1, p.Stats().Idle)
+}
+
+func TestPoolPauseQueuedRequest(t *testing.T) {
+	p, err := NewPool(genBasePoolConfig())
+	be.NilErr(t, err)
+	defer p.Close()
+
+	inUse, err := p.AcquireConn()
+	be.NilErr(t, err)
+
+	// The request waits for a conn before the pool is paused.
+	scCh := make(chan *ServerConn, 1)
+	go func() {
+		sc, err := p.AcquireConn()
+		if err == nil {
+			scCh <- sc
+		}
+	}()
+	for p.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	p.Pause()
+
+	// The conn released while paused is not handed to it.
+	p.ReleaseConn(inUse)
+	be.Equal(t, 0, p.Stats().OpenConnections)
+	select {
+	case <-scCh:
+		t.Fatal("got a conn from a paused pool")
+	case <-time.After(10 * time.Millisecond):
+	}
+	be.Equal(t, 1, p.Stats().Waiting)
+
+	p.Resume()
+	p.ReleaseConn(<-scCh)
+}
+
+func TestPoolReconnect(t *testing.T) {
+	cfg := genBasePoolConfig()
+	cfg.MaxOpen = 2
+	cfg.MaxIdle = 2
+
+	p, err := NewPool(cfg)
+	be.NilErr(t, err)
+	defer p.Close()
+
+	idle, err := p.AcquireConn()
+	be.NilErr(t, err)
+	inUse, err := p.AcquireConn()
+	be.NilErr(t, err)
+	p.ReleaseConn(idle)
+
+	spawned := 0
+	p.Reconnect(func(ctx context.Context) (Conner, error) {
+		spawned++
+		return &connMock{}, nil
+	})
+	be.Equal(t, 1, p.Stats().OpenConnections)
+
+	// The conn from before the reconnect is closed when released.
+	p.ReleaseConn(inUse)
+	be.Equal(t, 0, p.Stats().OpenConnections)
+
+	sc, err := p.AcquireConn()
+	be.NilErr(t, err)
+	p.ReleaseConn(sc)
+	be.Equal(t, 1, spawned)
+	be.Equal(t, 1, p.Stats().Idle)
+}
+
+func TestPoolAcquirePrefer(t *testing.T) {
+	cfg := genBasePoolConfig()
+	cfg.MaxOpen = 2
+	cfg.MaxIdle = 2
+
+	p, err := NewPool(cfg)
+	be.NilErr(t, err)
+	defer p.Close()
+
+	sc1, err := p.AcquireConn()
+	be.NilErr(t, err)
+	sc2, err := p.AcquireConn()
+	be.NilErr(t, err)
+	sc1.state = sessionState{"search_path": `"tenant1"`}
+	sc2.state = sessionState{"search_path": `"tenant2"`}
+	p.ReleaseConn(sc1)
+	p.ReleaseConn(sc2)
+
+	// Without a preference, the most recently released conn is used.
+	sc, err := p.AcquireConn()
+	be.NilErr(t, err)
+	be.Equal(t, sc2, sc)
+	p.ReleaseConn(sc)
+
+	// With one, an idle conn which matches it is used instead.
+	prefer := func(sc *ServerConn) bool {
+		return sc.state["search_path"] == `"tenant1"`
+	}
+	sc, err = p.AcquireConnPrefer(prefer)
+	be.NilErr(t, err)
+	be.Equal(t, sc1, sc)
+
+	// The other conn is still idle.
+	be.Equal(t, 1, p.Stats().Idle)
+	p.ReleaseConn(sc)
+}
+
+func TestPoolReloadConnCreateTimeout(t *testing.T) {
+	cfg := genBasePoolConfig()
+	cfg.ConnCreateTimeout = time.Hour
+	cfg.SpawnConn = func(ctx context.Context) (Conner, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	p, err := NewPool(cfg)
+	be.NilErr(t, err)
+	defer p.Close()
+
+	// The new timeout applies to the conns opened after the reload.
+	cfg.ConnCreateTimeout = 10 * time.Millisecond
+	p.Reload(cfg)
+	_, err = p.AcquireConn()
+	be.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestServerConnInfo(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	sc := &ServerConn{conn: &pipeConnMock{conn: c1}, createdAt: time.Now()}
+	info, ok := sc.info()
+	be.True(t, ok)
+	be.Equal(t, sc.createdAt, info.createdAt)
+
+	// A closed conn has nothing to show.
+	sc.closed = true
+	_, ok = sc.info()
+	be.False(t, ok)
+}
+
 func genBasePoolConfig() PoolConfig {
 	return PoolConfig{
 		SpawnConn: func(ctx context.Context) (Conner, error) {
 			return &connMock{}, nil
 		},
-		Logger:  log.Default(),
+		Logger:  slog.Default(),
 		MaxOpen: 1,
 		MaxIdle: 1,
 	}
@@ -83,6 +309,17 @@ func (mc *connMock) CancelRequest(_ context.Context) error {
 	return nil
 }
 
+func (mc *connMock) PID() uint32 {
+	return 0
+}
+
+func (mc *connMock) ParameterStatus(key string) string {
+	if key == "server_version" {
+		return "15.1"
+	}
+	return ""
+}
+
 func (mc *connMock) Close(_ context.Context) error {
 	return nil
 }
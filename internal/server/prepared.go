@@ -0,0 +1,184 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"slices"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// defaultMaxPreparedStmts is the number of statements
+// kept prepared on a server conn, if not set.
+const defaultMaxPreparedStmts = 100
+
+// stmtName returns the name a statement is prepared with on the server.
+// It is derived from the statement itself, so that a statement prepared
+// by one client can be used by the next client of the server conn. The
+// search_path is part of it, since the tables of a statement are looked
+// up when it is prepared, and tenants with different schemas share conns.
+func stmtName(searchPath, query string, paramOIDs []uint32) string {
+	h := sha256.New()
+	h.Write([]byte(searchPath))
+	h.Write([]byte{0})
+	h.Write([]byte(query))
+	for _, oid := range paramOIDs {
+		h.Write(binary.BigEndian.AppendUint32(nil, oid))
+	}
+	return "perseus_" + hex.EncodeToString(h.Sum(nil)[:12])
+}
+
+// stmtCache is an LRU of the names of the statements prepared on a server conn.
+type stmtCache struct {
+	max   int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newStmtCache(max int) *stmtCache {
+	if max <= 0 {
+		max = defaultMaxPreparedStmts
+	}
+	return &stmtCache{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// contains reports whether the statement is prepared, and marks it as used.
+func (c *stmtCache) contains(name string) bool {
+	elem, ok := c.items[name]
+	if ok {
+		c.ll.MoveToFront(elem)
+	}
+	return ok
+}
+
+func (c *stmtCache) add(name string) {
+	if elem, ok := c.items[name]; ok {
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.items[name] = c.ll.PushFront(name)
+}
+
+func (c *stmtCache) remove(name string) {
+	if elem, ok := c.items[name]; ok {
+		c.ll.Remove(elem)
+		delete(c.items, name)
+	}
+}
+
+// evict removes the least recently used statements, so that n more fit.
+// It returns the removed names, which have to be closed on the server.
+func (c *stmtCache) evict(n int) []string {
+	var names []string
+	for c.ll.Len() > 0 && c.ll.Len()+n > c.max {
+		name := c.ll.Remove(c.ll.Back()).(string)
+		delete(c.items, name)
+		names = append(names, name)
+	}
+	return names
+}
+
+func (c *stmtCache) clear() {
+	c.ll.Init()
+	clear(c.items)
+}
+
+// pendingReply is a reply expected from the server for a Parse or
+// Close which was sent to it. Replies to the messages sent by Perseus
+// itself are not forwarded to the client.
+type pendingReply struct {
+	// name is the name of the prepared statement, if any.
+	name    string
+	forward bool
+}
+
+// sendExtended sends a message of the extended protocol to the server.
+// Named statements are tracked for the client, and renamed after their
+// content on the server. A statement is prepared again on a server conn
+// which does not have it, before it is used.
+func (cc *ClientConn) sendExtended(serverEnd *pgproto3.Frontend, feMsg pgproto3.FrontendMessage) {
+	switch msg := feMsg.(type) {
+	case *pgproto3.Parse:
+		if msg.Name == "" {
+			cc.pendingParses = append(cc.pendingParses, pendingReply{forward: true})
+			break
+		}
+		// The message is reused by the next Receive, so it is copied.
+		stmt := &pgproto3.Parse{
+			Name:          stmtName(cc.searchPath, msg.Query, msg.ParameterOIDs),
+			Query:         msg.Query,
+			ParameterOIDs: slices.Clone(msg.ParameterOIDs),
+		}
+		cc.stmts[msg.Name] = stmt
+		cc.prepare(serverEnd, stmt, true)
+		return
+	case *pgproto3.Bind:
+		if stmt, ok := cc.stmts[msg.PreparedStatement]; ok {
+			cc.ensurePrepared(serverEnd, stmt)
+			bind := *msg
+			bind.PreparedStatement = stmt.Name
+			feMsg = &bind
+		}
+	case *pgproto3.Describe:
+		if stmt, ok := cc.stmts[msg.Name]; ok && msg.ObjectType == 'S' {
+			cc.ensurePrepared(serverEnd, stmt)
+			feMsg = &pgproto3.Describe{ObjectType: 'S', Name: stmt.Name}
+		}
+	case *pgproto3.Close:
+		if stmt, ok := cc.stmts[msg.Name]; ok && msg.ObjectType == 'S' {
+			delete(cc.stmts, msg.Name)
+			cc.serverConn.prepared.remove(stmt.Name)
+			feMsg = &pgproto3.Close{ObjectType: 'S', Name: stmt.Name}
+		}
+		cc.pendingCloses = append(cc.pendingCloses, pendingReply{forward: true})
+	}
+	cc.sendToServer(serverEnd, feMsg)
+}
+
+// ensurePrepared prepares the statement on the server conn,
+// unless it is already prepared, or about to be.
+func (cc *ClientConn) ensurePrepared(serverEnd *pgproto3.Frontend, stmt *pgproto3.Parse) {
+	if cc.serverConn.prepared.contains(stmt.Name) {
+		return
+	}
+	for _, p := range cc.pendingParses {
+		if p.name == stmt.Name {
+			return
+		}
+	}
+	cc.prepare(serverEnd, stmt, false)
+}
+
+// prepare sends the statement to the server, making room for it by
+// closing the least recently used ones. The statement is closed first
+// in case the server has it without Perseus knowing, like when an
+// earlier Close was skipped by the server after an error.
+func (cc *ClientConn) prepare(serverEnd *pgproto3.Frontend, stmt *pgproto3.Parse, forward bool) {
+	cache := cc.serverConn.prepared
+	cache.remove(stmt.Name)
+	for _, name := range cache.evict(len(cc.pendingParses) + 1) {
+		cc.sendToServer(serverEnd, &pgproto3.Close{ObjectType: 'S', Name: name})
+		cc.pendingCloses = append(cc.pendingCloses, pendingReply{name: name})
+	}
+	cc.sendToServer(serverEnd, &pgproto3.Close{ObjectType: 'S', Name: stmt.Name})
+	cc.pendingCloses = append(cc.pendingCloses, pendingReply{name: stmt.Name})
+	cc.sendToServer(serverEnd, stmt)
+	cc.pendingParses = append(cc.pendingParses, pendingReply{name: stmt.Name, forward: forward})
+}
+
+// popReply returns the first pending reply. Replies which are not
+// expected are forwarded.
+func popReply(pending *[]pendingReply) pendingReply {
+	if len(*pending) == 0 {
+		return pendingReply{forward: true}
+	}
+	reply := (*pending)[0]
+	*pending = (*pending)[1:]
+	return reply
+}
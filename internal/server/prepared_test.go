@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/carlmjohnson/be"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+func TestStmtCache(t *testing.T) {
+	c := newStmtCache(2)
+	c.add("a")
+	c.add("b")
+	be.True(t, c.contains("a"))
+
+	// b is the least recently used now.
+	be.AllEqual(t, []string{"b"}, c.evict(1))
+	be.False(t, c.contains("b"))
+	be.Equal(t, 0, len(c.evict(1)))
+
+	c.clear()
+	be.False(t, c.contains("a"))
+}
+
+func TestSendExtended(t *testing.T) {
+	var buf bytes.Buffer
+	serverEnd := pgproto3.NewFrontend(nil, &buf)
+	cc := &ClientConn{
+		serverConn: &ServerConn{prepared: newStmtCache(10)},
+		stmts:      make(map[string]*pgproto3.Parse),
+	}
+
+	query := "SELECT $1::int"
+	name := stmtName("", query, nil)
+	cc.sendExtended(serverEnd, &pgproto3.Parse{Name: "s1", Query: query})
+	cc.sendExtended(serverEnd, &pgproto3.Bind{PreparedStatement: "s1"})
+	cc.sendExtended(serverEnd, &pgproto3.Sync{})
+	be.NilErr(t, serverEnd.Flush())
+	be.Equal(t, `Close(S, `+name+`) Parse(`+name+`) Bind(`+name+`) Sync`, receiveAll(&buf))
+
+	// The statement is on the server conn once its Parse completes.
+	cc.serverConn.prepared.add(popReply(&cc.pendingParses).name)
+	cc.pendingCloses = nil
+
+	// On another server conn, it is prepared again, without
+	// forwarding the ParseComplete to the client.
+	cc.serverConn = &ServerConn{prepared: newStmtCache(10)}
+	cc.sendExtended(serverEnd, &pgproto3.Bind{PreparedStatement: "s1"})
+	cc.sendExtended(serverEnd, &pgproto3.Describe{ObjectType: 'S', Name: "s1"})
+	be.NilErr(t, serverEnd.Flush())
+	be.Equal(t, `Close(S, `+name+`) Parse(`+name+`) Bind(`+name+`) Describe(S, `+name+`)`, receiveAll(&buf))
+	be.Equal(t, 1, len(cc.pendingParses))
+	be.False(t, cc.pendingParses[0].forward)
+}
+
+func TestSendExtendedSearchPath(t *testing.T) {
+	var buf bytes.Buffer
+	serverEnd := pgproto3.NewFrontend(nil, &buf)
+	sc := &ServerConn{prepared: newStmtCache(10)}
+	cc1 := &ClientConn{serverConn: sc, searchPath: `"tenant1"`, stmts: make(map[string]*pgproto3.Parse)}
+	cc2 := &ClientConn{serverConn: sc, searchPath: `"tenant2"`, stmts: make(map[string]*pgproto3.Parse)}
+
+	query := "SELECT * FROM posts"
+	cc1.sendExtended(serverEnd, &pgproto3.Parse{Name: "s1", Query: query})
+	sc.prepared.add(popReply(&cc1.pendingParses).name)
+
+	// The next client of the conn has another schema, so the statement
+	// of the first one, which reads its tables, is not reused.
+	name1, name2 := stmtName(`"tenant1"`, query, nil), stmtName(`"tenant2"`, query, nil)
+	be.True(t, name1 != name2)
+	cc2.sendExtended(serverEnd, &pgproto3.Parse{Name: "s1", Query: query})
+	cc2.sendExtended(serverEnd, &pgproto3.Bind{PreparedStatement: "s1"})
+	be.NilErr(t, serverEnd.Flush())
+	be.Equal(t, `Close(S, `+name1+`) Parse(`+name1+`) Close(S, `+name2+`) Parse(`+name2+`) Bind(`+name2+`)`, receiveAll(&buf))
+	be.True(t, sc.prepared.contains(name1))
+}
+
+// receiveAll decodes the messages sent to the server, in a short form.
+func receiveAll(buf *bytes.Buffer) string {
+	backend := pgproto3.NewBackend(buf, nil)
+	var msgs []string
+	for {
+		// Receive fails once all the messages are read.
+		msg, err := backend.Receive()
+		if err != nil {
+			break
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.Close:
+			msgs = append(msgs, "Close("+string(msg.ObjectType)+", "+msg.Name+")")
+		case *pgproto3.Parse:
+			msgs = append(msgs, "Parse("+msg.Name+")")
+		case *pgproto3.Bind:
+			msgs = append(msgs, "Bind("+msg.PreparedStatement+")")
+		case *pgproto3.Describe:
+			msgs = append(msgs, "Describe("+string(msg.ObjectType)+", "+msg.Name+")")
+		case *pgproto3.Sync:
+			msgs = append(msgs, "Sync")
+		}
+	}
+	return strings.Join(msgs, " ")
+}
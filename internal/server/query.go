@@ -2,8 +2,11 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,111 +20,258 @@ const (
 	StatusError byte = 'E'
 )
 
+// Pool modes decide when a client gives its server conn back to the pool.
+const (
+	// PoolModeSession keeps the server conn until the client disconnects.
+	PoolModeSession = "session"
+	// PoolModeTransaction releases the server conn after every transaction.
+	PoolModeTransaction = "transaction"
+	// PoolModeStatement releases the server conn after every query,
+	// and does not allow transactions which span queries.
+	PoolModeStatement = "statement"
+)
+
 type ClientConn struct {
 	handle   *pgproto3.Backend
 	txStatus byte
-	logger   *log.Logger
+	logger   *slog.Logger
 	pool     *Pool
+	mode     string
+	metrics  *destMetrics
 
-	// mut makes the getting of pool, and setting of the serverConn
-	// atomic. This allows us to find the serverConn for a clientConn
-	// to cancel a request.
+	// conn is the underlying client connection, used to kill the client.
+	conn        net.Conn
+	user        string
+	database    string
+	connectedAt time.Time
+
+	// mut guards the setting of serverConn, so that other goroutines, like
+	// the ones handling cancel requests, can use it. serverConn is only set
+	// by the handler of the client, which reads it without the lock.
 	mut sync.Mutex
-	// This is set to non-nil if there's an active transaction going on.
+	// This is set to non-nil if there's an active transaction going on,
+	// or for the whole session in session mode.
 	serverConn *ServerConn
+	// txStart is the time serverConn was acquired.
+	txStart time.Time
+	// queryStart is the time the current query was sent. It is
+	// zero when the server is ready for the next query.
+	queryStart time.Time
 
 	schema string
+	// searchPath is the search_path of the client, as a list of quoted identifiers.
+	searchPath string
+	// params are the tracked session params of the client, which
+	// are applied to every server conn it acquires.
+	params map[string]string
+
+	// stmts are the named statements prepared by the client, as
+	// they are sent to the server, keyed by the client's name.
+	stmts map[string]*pgproto3.Parse
+	// pendingParses and pendingCloses are the replies expected
+	// from the server until the next ReadyForQuery.
+	pendingParses []pendingReply
+	pendingCloses []pendingReply
+	// pendingReplies is the number of extended protocol messages the
+	// server has not replied to yet. It tells when the responses to a
+	// Flush are complete.
+	pendingReplies int
+	// failed is set when the server reported an error in the current
+	// batch. The server then skips the messages until the next Sync.
+	failed bool
+
+	// listening is set once the client runs LISTEN. The server
+	// conn is kept until the client disconnects.
+	listening bool
+	// relayDone is non-nil while the messages the server sends
+	// on its own are relayed to the idle client.
+	relayDone chan error
 }
 
-func NewClientConn(handle *pgproto3.Backend, logger *log.Logger, pool *Pool, schema string) *ClientConn {
+func NewClientConn(handle *pgproto3.Backend, logger *slog.Logger, pool *Pool, mode string, params *startupParams, conn net.Conn, metrics *destMetrics) *ClientConn {
 	return &ClientConn{
-		handle: handle,
-		logger: logger,
-		pool:   pool,
-		schema: schema,
+		handle:      handle,
+		logger:      logger,
+		pool:        pool,
+		mode:        mode,
+		metrics:     metrics,
+		conn:        conn,
+		user:        params.username,
+		database:    params.database,
+		schema:      params.schema,
+		searchPath:  formatSearchPath(params.searchPath),
+		params:      params.session,
+		stmts:       make(map[string]*pgproto3.Parse),
+		connectedAt: time.Now(),
+		// The client is idle until its first query, even
+		// though the server has not told it so yet.
+		txStatus: StatusIdle,
 	}
 }
 
 func (cc *ClientConn) handleQuery(feMsg pgproto3.FrontendMessage) error {
 	// Leasing a connection
 	if err := cc.acquireConn(); err != nil {
-		return err
+		return cc.sendErrorAndReady(cc.acquireError(err))
 	}
 
-	serverEnd := pgproto3.NewFrontend(cc.serverConn.Conn(), cc.serverConn.Conn())
-	// serverEnd.Trace(cc.logger.Writer(), pgproto3.TracerOptions{})
+	serverEnd := cc.serverConn.Frontend()
 	serverEnd.Send(feMsg)
+	cc.queryStart = time.Now()
 	if err := serverEnd.Flush(); err != nil {
-		return fmt.Errorf("error while flushing queryMsg: %w", err)
+		return cc.serverConnLost(fmt.Errorf("error while flushing queryMsg: %w", err), true)
 	}
 
-	if err := cc.readBackendResponse(serverEnd); err != nil {
+	if err := cc.readBackendResponse(serverEnd, true); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// handleExtendedQuery forwards the messages of the extended protocol up to
+// the next Sync or Flush. After a Sync, the responses are read until the
+// server is ready for the next query. After a Flush, they are read until
+// the server has replied to every message sent so far, and the server
+// conn is kept until the Sync which ends the batch.
 func (cc *ClientConn) handleExtendedQuery(feMsg pgproto3.FrontendMessage) error {
+	if cc.serverConn == nil {
+		switch feMsg.(type) {
+		case *pgproto3.Sync:
+			// There is nothing to sync without a server conn.
+			cc.handle.Send(&pgproto3.ReadyForQuery{TxStatus: StatusIdle})
+			if err := cc.handle.Flush(); err != nil {
+				return fmt.Errorf("error while flushing to client: %w", err)
+			}
+			return nil
+		case *pgproto3.Flush:
+			return nil
+		}
+	}
+
 	// Leasing a connection
 	if err := cc.acquireConn(); err != nil {
-		return err
+		return cc.discardBatch(cc.acquireError(err))
 	}
 
-	serverEnd := pgproto3.NewFrontend(cc.serverConn.Conn(), cc.serverConn.Conn())
-	// serverEnd.Trace(cc.logger.Writer(), pgproto3.TracerOptions{})
-	serverEnd.Send(feMsg)
-
+	serverEnd := cc.serverConn.Frontend()
 	for {
-		feMsg, err := cc.handle.Receive()
-		if err != nil {
-			return fmt.Errorf("error while receiving msg in extendedQuery: %w", err)
-		}
-
-		serverEnd.Send(feMsg)
+		cc.sendExtended(serverEnd, feMsg)
 
-		// Keep reading until we see a SYNC message
-		_, ok := feMsg.(*pgproto3.Sync)
-		if ok {
-			break
+		switch feMsg.(type) {
+		case *pgproto3.Sync, *pgproto3.Flush:
+			if cc.queryStart.IsZero() {
+				cc.queryStart = time.Now()
+			}
+			_, isSync := feMsg.(*pgproto3.Sync)
+			if err := serverEnd.Flush(); err != nil {
+				return cc.serverConnLost(fmt.Errorf("error while flushing extendedQuery: %w", err), isSync)
+			}
+			return cc.readBackendResponse(serverEnd, isSync)
 		}
-	}
 
-	if err := serverEnd.Flush(); err != nil {
-		return fmt.Errorf("error while flushing extendedQuery: %w", err)
-	}
-
-	if err := cc.readBackendResponse(serverEnd); err != nil {
-		return err
+		var err error
+		feMsg, err = cc.handle.Receive()
+		if err != nil {
+			return fmt.Errorf("error while receiving msg in extendedQuery: %w", err)
+		}
 	}
-
-	return nil
 }
 
-func (cc *ClientConn) readBackendResponse(serverEnd *pgproto3.Frontend) error {
+// readBackendResponse relays the responses of the server to the client.
+// If waitReady is false, it returns once the server has replied to every
+// message sent so far, instead of waiting for ReadyForQuery.
+func (cc *ClientConn) readBackendResponse(serverEnd *pgproto3.Frontend, waitReady bool) error {
 	// Read the response
 	cnt := 0
 	for {
+		if !waitReady && cc.pendingReplies == 0 {
+			if err := cc.handle.Flush(); err != nil {
+				return fmt.Errorf("error while flushing to client: %w", err)
+			}
+			return nil
+		}
+
 		beMsg, err := serverEnd.Receive()
 		if err != nil {
-			return fmt.Errorf("error while receiving from server: %w", err)
+			return cc.serverConnLost(fmt.Errorf("error while receiving from server: %w", err), waitReady)
 		}
 		cnt++
+		cc.trackReply(beMsg)
 
 		switch typedMsg := beMsg.(type) {
+		case *pgproto3.ParameterStatus:
+			cc.trackParam(typedMsg)
+			cc.handle.Send(typedMsg)
+		case *pgproto3.CommandComplete:
+			if string(typedMsg.CommandTag) == "LISTEN" && !cc.listening {
+				cc.logger.Debug("Keeping the server conn for LISTEN", "backend_pid", cc.serverConn.PID())
+				cc.listening = true
+			}
+			// The client changed some setting, possibly one which is not
+			// reported, like search_path. Forget what the conn has.
+			if isSessionCommand(typedMsg.CommandTag) {
+				cc.serverConn.state = nil
+			}
+			if dropsPreparedStmts(typedMsg.CommandTag) {
+				cc.serverConn.prepared.clear()
+			}
+			cc.handle.Send(typedMsg)
+		case *pgproto3.ParseComplete:
+			reply := popReply(&cc.pendingParses)
+			if reply.name != "" {
+				cc.serverConn.prepared.add(reply.name)
+			}
+			if reply.forward {
+				cc.handle.Send(typedMsg)
+			}
+		case *pgproto3.CloseComplete:
+			if reply := popReply(&cc.pendingCloses); reply.forward {
+				cc.handle.Send(typedMsg)
+			}
+		case *pgproto3.CopyInResponse:
+			cc.handle.Send(typedMsg)
+			if err := cc.handle.Flush(); err != nil {
+				return fmt.Errorf("error while flushing to client: %w", err)
+			}
+			if err := cc.copyIn(serverEnd); err != nil {
+				return err
+			}
+		case *pgproto3.CopyBothResponse:
+			cc.handle.Send(typedMsg)
+			if err := cc.handle.Flush(); err != nil {
+				return fmt.Errorf("error while flushing to client: %w", err)
+			}
+			if err := cc.copyBoth(serverEnd); err != nil {
+				return err
+			}
 		// Read all till ReadyForQuery
 		case *pgproto3.ReadyForQuery:
+			// Replies still pending were skipped by the server after an error.
+			cc.pendingParses = cc.pendingParses[:0]
+			cc.pendingCloses = cc.pendingCloses[:0]
+			cc.pendingReplies = 0
+			cc.failed = false
+			cc.txStatus = typedMsg.TxStatus
+			cc.metrics.queryDuration.Observe(time.Since(cc.queryStart).Seconds())
+			cc.queryStart = time.Time{}
+			if cc.mode == PoolModeStatement && cc.txStatus != StatusIdle {
+				// Closing the client closes the server conn as well,
+				// which rolls the transaction back.
+				err := fatalf(codeFeatureNotSupported, "transaction blocks are not allowed in statement pool mode")
+				sendAndFlush(cc.handle, err)
+				return err
+			}
+
 			cc.handle.Send(typedMsg)
 			if err := cc.handle.Flush(); err != nil {
 				return fmt.Errorf("error while flushing to client: %w", err)
 			}
-			cc.txStatus = typedMsg.TxStatus
 
 			// Releasing the conn back to the pool
-			if cc.txStatus == StatusIdle {
+			if cc.txStatus == StatusIdle && cc.mode != PoolModeSession && !cc.listening {
 				cc.mut.Lock()
-				cc.pool.ReleaseConn(cc.serverConn)
-				cc.serverConn = nil
+				cc.releaseConnLocked()
 				cc.mut.Unlock()
 			}
 			return nil
@@ -133,48 +283,359 @@ func (cc *ClientConn) readBackendResponse(serverEnd *pgproto3.Frontend) error {
 					return fmt.Errorf("error while flushing to client: %w", err)
 				}
 			}
-			continue
 		}
 	}
 }
 
+// copyIn streams the data of a COPY FROM STDIN from the client to the
+// server, up to the CopyDone or CopyFail which ends it. The data of a
+// COPY TO STDOUT needs no special handling, it is relayed like any
+// other response.
+func (cc *ClientConn) copyIn(serverEnd *pgproto3.Frontend) error {
+	for cnt := 1; ; cnt++ {
+		feMsg, err := cc.handle.Receive()
+		if err != nil {
+			return fmt.Errorf("error while receiving copy data from client: %w", err)
+		}
+
+		switch feMsg.(type) {
+		case *pgproto3.CopyData:
+			serverEnd.Send(feMsg)
+			// Flush if we have queued too many messages
+			if cnt%10 == 0 {
+				if err := serverEnd.Flush(); err != nil {
+					return fmt.Errorf("error while flushing copy data: %w", err)
+				}
+			}
+		case *pgproto3.CopyDone, *pgproto3.CopyFail:
+			serverEnd.Send(feMsg)
+			if err := serverEnd.Flush(); err != nil {
+				return fmt.Errorf("error while flushing copy data: %w", err)
+			}
+			return nil
+		case *pgproto3.Flush, *pgproto3.Sync:
+			// The server ignores these during a copy.
+			serverEnd.Send(feMsg)
+		default:
+			return fmt.Errorf("unexpected message %T during copy", feMsg)
+		}
+	}
+}
+
+// copyBoth relays the data of a copy in both directions at the same time,
+// until both the client and the server have sent CopyDone.
+func (cc *ClientConn) copyBoth(serverEnd *pgproto3.Frontend) error {
+	// Receiving from the client and sending to the server do not
+	// touch the state used for the other direction.
+	clientDone := make(chan error, 1)
+	go func() {
+		clientDone <- cc.copyIn(serverEnd)
+	}()
+	// stopClient interrupts the goroutine reading from the client,
+	// and waits for it, so that it no longer uses the server conn.
+	stopClient := func() {
+		cc.conn.SetReadDeadline(time.Now())
+		<-clientDone
+	}
+
+	for {
+		beMsg, err := serverEnd.Receive()
+		if err != nil {
+			stopClient()
+			return fmt.Errorf("error while receiving from server: %w", err)
+		}
+		cc.handle.Send(beMsg)
+		if err := cc.handle.Flush(); err != nil {
+			stopClient()
+			return fmt.Errorf("error while flushing to client: %w", err)
+		}
+
+		switch beMsg.(type) {
+		case *pgproto3.CopyDone:
+			// The rest of the response is read once the client is done too.
+			return <-clientDone
+		case *pgproto3.ErrorResponse:
+			// The copy is over, but the client might keep sending data.
+			// There is no telling where it would stop, so it is closed.
+			stopClient()
+			return errors.New("error from server during copy")
+		}
+	}
+}
+
+// sendToServer sends a message to the server, counting
+// the reply the server owes for it, if any.
+func (cc *ClientConn) sendToServer(serverEnd *pgproto3.Frontend, feMsg pgproto3.FrontendMessage) {
+	switch feMsg.(type) {
+	case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe, *pgproto3.Execute, *pgproto3.Close:
+		if !cc.failed {
+			cc.pendingReplies++
+		}
+	}
+	serverEnd.Send(feMsg)
+}
+
+// trackReply counts the replies to the messages sent with
+// sendToServer. Each of them ends with one of these messages.
+func (cc *ClientConn) trackReply(beMsg pgproto3.BackendMessage) {
+	switch beMsg.(type) {
+	case *pgproto3.ParseComplete, *pgproto3.BindComplete, *pgproto3.CloseComplete,
+		*pgproto3.RowDescription, *pgproto3.NoData, *pgproto3.CommandComplete,
+		*pgproto3.EmptyQueryResponse, *pgproto3.PortalSuspended:
+		if cc.pendingReplies > 0 {
+			cc.pendingReplies--
+		}
+	case *pgproto3.ErrorResponse:
+		// The server skips the rest of the batch.
+		cc.failed = true
+		cc.pendingReplies = 0
+	}
+}
+
 func (cc *ClientConn) acquireConn() error {
-	cc.mut.Lock()
-	defer cc.mut.Unlock()
 	if cc.serverConn != nil {
 		return nil
 	}
 
-	conn, err := cc.pool.AcquireConn()
+	desired := cc.sessionState()
+	acquireStart := time.Now()
+	conn, err := cc.pool.AcquireConnPrefer(func(sc *ServerConn) bool {
+		return sc.state != nil && sc.state["search_path"] == desired["search_path"]
+	})
+	cc.metrics.acquireWait.Observe(time.Since(acquireStart).Seconds())
 	if err != nil {
 		return fmt.Errorf("error while acquiring conn: %w", err)
 	}
 	// We have just got a connection from the pool. First, we check
 	// whether it's healthy or not.
 	if err := conn.CheckConn(); err != nil {
-		// *Server.handleConn will take care of closing the connection.
+		// The conn is broken, so it is not returned to the pool.
+		conn.Close()
 		return fmt.Errorf("error while checking conn: %w", err)
 	}
 
-	// This is a low-level method, so passing params is not really supported.
-	// We need to implement sanitization ourselves. XXX: item for future.
-	err = conn.Exec(fmt.Sprintf(`SET search_path='%s'`, cc.schema))
-	if err != nil {
-		return fmt.Errorf("error setting schema search path: %w", err)
+	// Only the settings which differ from the ones the conn
+	// already has are sent, together to save round trips.
+	if stmts := sessionStmts(desired, conn.state); len(stmts) > 0 {
+		if err := conn.Exec(strings.Join(stmts, "; ")); err != nil {
+			// The conn is in an unknown state.
+			conn.Close()
+			return fmt.Errorf("error setting session params: %w", err)
+		}
 	}
+	conn.state = desired
 
+	cc.mut.Lock()
 	cc.serverConn = conn
+	cc.mut.Unlock()
+	cc.txStart = time.Now()
 	return nil
 }
 
+// releaseConnLocked returns the server conn to the pool. cc.mut must be held.
+func (cc *ClientConn) releaseConnLocked() {
+	cc.metrics.txDuration.Observe(time.Since(cc.txStart).Seconds())
+	if cc.listening {
+		// The reset query might leave the channels listened to, and
+		// their notifications must not reach the next client.
+		cc.listening = false
+		if err := cc.serverConn.Exec("UNLISTEN *"); err != nil {
+			cc.logger.Warn("Error unlistening, closing server conn", "backend_pid", cc.serverConn.PID(), "err", err)
+			cc.serverConn.Close()
+			cc.serverConn = nil
+			return
+		}
+	}
+	// Notifications and other async messages which were read along with
+	// the last reply to the client must not reach the next client either.
+	if err := cc.serverConn.discardAsync(); err != nil {
+		cc.logger.Warn("Error discarding async messages, closing server conn", "backend_pid", cc.serverConn.PID(), "err", err)
+		cc.serverConn.Close()
+		cc.serverConn = nil
+		return
+	}
+	if cc.mode == PoolModeSession {
+		cc.pool.ReleaseSessionConn(cc.serverConn)
+	} else {
+		cc.pool.ReleaseConn(cc.serverConn)
+	}
+	cc.serverConn = nil
+}
+
+// trackParam remembers a param the client changed with SET,
+// so that it is applied to the next server conn as well.
+func (cc *ClientConn) trackParam(msg *pgproto3.ParameterStatus) {
+	if !trackedParams[msg.Name] {
+		return
+	}
+	cc.params[msg.Name] = msg.Value
+	if cc.serverConn.state != nil {
+		cc.serverConn.state[msg.Name] = quoteLiteral(msg.Value)
+	}
+}
+
+// keepsIdleConn reports whether the client holds its server conn while it
+// is idle, because it is in session mode or listening. A client which
+// holds it in the middle of an extended protocol batch, which was flushed
+// but not synced yet, is not idle, as the replies to the batch may follow.
+func (cc *ClientConn) keepsIdleConn() bool {
+	return cc.serverConn != nil && cc.txStatus == StatusIdle && cc.queryStart.IsZero() &&
+		(cc.mode == PoolModeSession || cc.listening)
+}
+
+// startRelay relays the messages the server sends on its own, like
+// notifications, notices and parameter changes, while the client is
+// idle and holds a server conn. It must be stopped with stopRelay
+// before the client or the server conn is used again.
+func (cc *ClientConn) startRelay() {
+	serverEnd := cc.serverConn.Frontend()
+	cc.relayDone = make(chan error, 1)
+	go func() {
+		for {
+			beMsg, err := serverEnd.Receive()
+			if err != nil {
+				cc.relayDone <- err
+				return
+			}
+			if msg, ok := beMsg.(*pgproto3.ParameterStatus); ok {
+				cc.trackParam(msg)
+			}
+			cc.handle.Send(beMsg)
+			if err := cc.handle.Flush(); err != nil {
+				cc.relayDone <- fmt.Errorf("error while flushing to client: %w", err)
+				return
+			}
+		}
+	}()
+}
+
+// stopRelay stops relaying by interrupting the read from the server.
+// A message which was partly read is completed by the next read.
+func (cc *ClientConn) stopRelay() error {
+	conn := cc.serverConn.Conn()
+	conn.SetReadDeadline(time.Now())
+	err := <-cc.relayDone
+	cc.relayDone = nil
+	conn.SetReadDeadline(time.Time{})
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil
+	}
+	return fmt.Errorf("error while receiving from server: %w", err)
+}
+
+// sessionState returns the state the server conn
+// should have while the client is using it.
+func (cc *ClientConn) sessionState() sessionState {
+	// The values are quoted, since Exec does not support placeholders.
+	state := sessionState{"search_path": cc.searchPath}
+	for name, value := range cc.params {
+		state[name] = quoteLiteral(value)
+	}
+	return state
+}
+
+// acquireError returns the error reported to the client when no server
+// conn could be acquired. The session goes on, so that the client can try
+// again with its next query, unless the pool is closed for good.
+func (cc *ClientConn) acquireError(err error) *pgError {
+	code := errorCode(err, codeCannotConnect)
+	if errors.Is(err, ErrPoolClosed) {
+		return fatalf(code, "%v", err)
+	}
+	cc.logger.Warn("Error acquiring server conn", "err", err)
+	return errorf(code, "%v", err)
+}
+
+// serverConnLost closes the server conn after it failed in the middle of
+// a query, and reports it to the client. If the client was outside of a
+// transaction, and does not rely on the session of the server conn, the
+// session goes on with another server conn. If the client has not sent
+// the Sync which ends its batch yet, the rest of the batch is discarded.
+func (cc *ClientConn) serverConnLost(err error, synced bool) error {
+	cc.logger.Warn("Lost server conn", "backend_pid", cc.serverConn.PID(), "err", err)
+	cc.mut.Lock()
+	cc.serverConn.Close()
+	cc.serverConn = nil
+	cc.mut.Unlock()
+	cc.pendingParses = cc.pendingParses[:0]
+	cc.pendingCloses = cc.pendingCloses[:0]
+	cc.pendingReplies = 0
+	cc.failed = false
+	cc.queryStart = time.Time{}
+
+	if cc.txStatus != StatusIdle || cc.mode == PoolModeSession || cc.listening {
+		err := fatalf(codeConnectionFailure, "lost the connection to the server: %v", err)
+		sendAndFlush(cc.handle, err)
+		return err
+	}
+	perr := errorf(codeConnectionFailure, "lost the connection to the server: %v", err)
+	if synced {
+		return cc.sendErrorAndReady(perr)
+	}
+	return cc.discardBatch(perr)
+}
+
+// sendErrorAndReady reports an error to the client, and tells it that it
+// can send the next query, keeping the session alive. The client is
+// closed instead after a FATAL error.
+func (cc *ClientConn) sendErrorAndReady(err *pgError) error {
+	if err.severity == severityFatal {
+		sendAndFlush(cc.handle, err)
+		return err
+	}
+	cc.handle.Send(err.response())
+	// There is no server conn, so the client is not in a transaction.
+	cc.handle.Send(&pgproto3.ReadyForQuery{TxStatus: StatusIdle})
+	if err := cc.handle.Flush(); err != nil {
+		return fmt.Errorf("error while flushing error to client: %w", err)
+	}
+	return nil
+}
+
+// discardBatch reports an error to the client, and discards its
+// messages up to the next Sync, the same way the server would after
+// an error. The error is flushed early if the client sends a Flush.
+func (cc *ClientConn) discardBatch(err *pgError) error {
+	if err.severity == severityFatal {
+		sendAndFlush(cc.handle, err)
+		return err
+	}
+	cc.handle.Send(err.response())
+	for {
+		feMsg, err := cc.handle.Receive()
+		if err != nil {
+			return fmt.Errorf("error while receiving msg in extendedQuery: %w", err)
+		}
+		switch feMsg.(type) {
+		case *pgproto3.Flush:
+			if err := cc.handle.Flush(); err != nil {
+				return fmt.Errorf("error while flushing error to client: %w", err)
+			}
+		case *pgproto3.Sync:
+			// There is no server conn, so the client is not in a transaction.
+			cc.handle.Send(&pgproto3.ReadyForQuery{TxStatus: StatusIdle})
+			if err := cc.handle.Flush(); err != nil {
+				return fmt.Errorf("error while flushing error to client: %w", err)
+			}
+			return nil
+		}
+	}
+}
+
+// CancelServerConn cancels the query running on the server conn of the
+// client, if it has one. The lock is held until the request is sent, so that
+// the conn cannot be released in the meantime, and the request cannot cancel
+// the query of the next client of the conn.
 func (cc *ClientConn) CancelServerConn() error {
 	cc.mut.Lock()
+	defer cc.mut.Unlock()
 	if cc.serverConn == nil {
 		return nil
 	}
-	cc.mut.Unlock()
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(cc.pool.connCreateTimeout))
+	ctx, cancel := context.WithTimeout(context.Background(), cc.pool.connCreateTimeout)
 	defer cancel()
 	return cc.serverConn.CancelRequest(ctx)
 }
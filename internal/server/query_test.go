@@ -0,0 +1,365 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/carlmjohnson/be"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestExtendedQueryFlush(t *testing.T) {
+	clientEnd, proxyClientEnd := net.Pipe()
+	defer clientEnd.Close()
+	serverEnd, proxyServerEnd := net.Pipe()
+	defer serverEnd.Close()
+
+	cc := newTestClientConn(proxyClientEnd, proxyServerEnd)
+	client := pgproto3.NewFrontend(clientEnd, clientEnd)
+	server := pgproto3.NewBackend(serverEnd, serverEnd)
+
+	// Like PostgreSQL, the server only writes out
+	// its replies on a Flush or a Sync.
+	go func() {
+		for {
+			msg, err := server.Receive()
+			if err != nil {
+				return
+			}
+			switch msg.(type) {
+			case *pgproto3.Parse:
+				server.Send(&pgproto3.ParseComplete{})
+			case *pgproto3.Bind:
+				server.Send(&pgproto3.BindComplete{})
+			case *pgproto3.Describe:
+				server.Send(&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("one")}}})
+			case *pgproto3.Execute:
+				server.Send(&pgproto3.DataRow{Values: [][]byte{[]byte("1")}})
+				server.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+			case *pgproto3.Flush:
+				server.Flush()
+			case *pgproto3.Sync:
+				server.Send(&pgproto3.ReadyForQuery{TxStatus: StatusIdle})
+				server.Flush()
+			}
+		}
+	}()
+
+	done := make(chan error, 1)
+	handle := func() {
+		msg, err := cc.handle.Receive()
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- cc.handleExtendedQuery(msg)
+	}
+
+	go handle()
+	client.Send(&pgproto3.Parse{Query: "SELECT 1"})
+	client.Send(&pgproto3.Bind{})
+	client.Send(&pgproto3.Describe{ObjectType: 'P'})
+	client.Send(&pgproto3.Execute{})
+	client.Send(&pgproto3.Flush{})
+	be.NilErr(t, client.Flush())
+
+	for _, want := range []pgproto3.BackendMessage{
+		&pgproto3.ParseComplete{},
+		&pgproto3.BindComplete{},
+		&pgproto3.RowDescription{},
+		&pgproto3.DataRow{},
+		&pgproto3.CommandComplete{},
+	} {
+		msg, err := client.Receive()
+		be.NilErr(t, err)
+		be.Equal(t, typeName(want), typeName(msg))
+	}
+	// The batch is not over, so the server conn is kept.
+	be.NilErr(t, <-done)
+	be.Nonzero(t, cc.serverConn)
+
+	go handle()
+	client.Send(&pgproto3.Sync{})
+	be.NilErr(t, client.Flush())
+	msg, err := client.Receive()
+	be.NilErr(t, err)
+	be.Equal(t, typeName(&pgproto3.ReadyForQuery{}), typeName(msg))
+	be.NilErr(t, <-done)
+}
+
+func TestCopyIn(t *testing.T) {
+	clientEnd, proxyClientEnd := net.Pipe()
+	defer clientEnd.Close()
+	serverEnd, proxyServerEnd := net.Pipe()
+	defer serverEnd.Close()
+
+	cc := newTestClientConn(proxyClientEnd, proxyServerEnd)
+	client := pgproto3.NewFrontend(clientEnd, clientEnd)
+	server := pgproto3.NewBackend(serverEnd, serverEnd)
+
+	rows := make(chan string, 10)
+	go func() {
+		defer close(rows)
+		for {
+			msg, err := server.Receive()
+			if err != nil {
+				return
+			}
+			switch msg := msg.(type) {
+			case *pgproto3.Query:
+				server.Send(&pgproto3.CopyInResponse{})
+				server.Flush()
+			case *pgproto3.CopyData:
+				rows <- string(msg.Data)
+			case *pgproto3.CopyDone:
+				server.Send(&pgproto3.CommandComplete{CommandTag: []byte("COPY 2")})
+				server.Send(&pgproto3.ReadyForQuery{TxStatus: StatusIdle})
+				server.Flush()
+			}
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		msg, err := cc.handle.Receive()
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- cc.handleQuery(msg)
+	}()
+
+	client.Send(&pgproto3.Query{String: "COPY t FROM STDIN"})
+	be.NilErr(t, client.Flush())
+	msg, err := client.Receive()
+	be.NilErr(t, err)
+	be.Equal(t, typeName(&pgproto3.CopyInResponse{}), typeName(msg))
+
+	client.Send(&pgproto3.CopyData{Data: []byte("1\n")})
+	client.Send(&pgproto3.CopyData{Data: []byte("2\n")})
+	client.Send(&pgproto3.CopyDone{})
+	be.NilErr(t, client.Flush())
+
+	for _, want := range []pgproto3.BackendMessage{
+		&pgproto3.CommandComplete{},
+		&pgproto3.ReadyForQuery{},
+	} {
+		msg, err := client.Receive()
+		be.NilErr(t, err)
+		be.Equal(t, typeName(want), typeName(msg))
+	}
+	be.NilErr(t, <-done)
+	be.Equal(t, "1\n", <-rows)
+	be.Equal(t, "2\n", <-rows)
+}
+
+func TestCopyBothServerError(t *testing.T) {
+	clientEnd, proxyClientEnd := net.Pipe()
+	defer clientEnd.Close()
+	serverEnd, proxyServerEnd := net.Pipe()
+	defer serverEnd.Close()
+
+	cc := newTestClientConn(proxyClientEnd, proxyServerEnd)
+	client := pgproto3.NewFrontend(clientEnd, clientEnd)
+	server := pgproto3.NewBackend(serverEnd, serverEnd)
+
+	go func() {
+		server.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "XX000", Message: "replication failed"})
+		server.Flush()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cc.copyBoth(cc.serverConn.Frontend())
+	}()
+
+	msg, err := client.Receive()
+	be.NilErr(t, err)
+	be.Equal(t, typeName(&pgproto3.ErrorResponse{}), typeName(msg))
+	// The client has not ended its side of the copy,
+	// but copyBoth returns without waiting for it.
+	be.Nonzero(t, <-done)
+}
+
+func TestRelayWhileIdle(t *testing.T) {
+	clientEnd, proxyClientEnd := net.Pipe()
+	defer clientEnd.Close()
+	serverEnd, proxyServerEnd := net.Pipe()
+	defer serverEnd.Close()
+
+	cc := newTestClientConn(proxyClientEnd, proxyServerEnd)
+	client := pgproto3.NewFrontend(clientEnd, clientEnd)
+	server := pgproto3.NewBackend(serverEnd, serverEnd)
+
+	cc.startRelay()
+	sent := make(chan error, 1)
+	go func() {
+		server.Send(&pgproto3.NotificationResponse{PID: 1, Channel: "events", Payload: "hello"})
+		server.Send(&pgproto3.ParameterStatus{Name: "TimeZone", Value: "UTC"})
+		sent <- server.Flush()
+	}()
+
+	msg, err := client.Receive()
+	be.NilErr(t, err)
+	notification, ok := msg.(*pgproto3.NotificationResponse)
+	be.True(t, ok)
+	be.Equal(t, "hello", notification.Payload)
+	msg, err = client.Receive()
+	be.NilErr(t, err)
+	be.Equal(t, typeName(&pgproto3.ParameterStatus{}), typeName(msg))
+
+	// The relay stops without losing the server conn.
+	be.NilErr(t, <-sent)
+	be.NilErr(t, cc.stopRelay())
+	be.Equal(t, "UTC", cc.params["TimeZone"])
+	go func() {
+		server.Send(&pgproto3.NoticeResponse{Message: "still here"})
+		server.Flush()
+	}()
+	msg, err = cc.serverConn.Frontend().Receive()
+	be.NilErr(t, err)
+	be.Equal(t, typeName(&pgproto3.NoticeResponse{}), typeName(msg))
+}
+
+// The first query of a new client is outside of a transaction,
+// so losing its server conn does not end the session.
+func TestServerConnLost(t *testing.T) {
+	clientEnd, proxyClientEnd := net.Pipe()
+	defer clientEnd.Close()
+	serverEnd, proxyServerEnd := net.Pipe()
+
+	cc := newTestClientConn(proxyClientEnd, proxyServerEnd)
+	cc.mode = PoolModeTransaction
+	client := pgproto3.NewFrontend(clientEnd, clientEnd)
+	server := pgproto3.NewBackend(serverEnd, serverEnd)
+
+	// The server goes away in the middle of the query.
+	go func() {
+		server.Receive()
+		serverEnd.Close()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		msg, err := cc.handle.Receive()
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- cc.handleQuery(msg)
+	}()
+
+	client.Send(&pgproto3.Query{String: "SELECT 1"})
+	be.NilErr(t, client.Flush())
+	msg, err := client.Receive()
+	be.NilErr(t, err)
+	errResp, ok := msg.(*pgproto3.ErrorResponse)
+	be.True(t, ok)
+	be.Equal(t, "ERROR", errResp.Severity)
+	be.Equal(t, codeConnectionFailure, errResp.Code)
+
+	// Outside of a transaction, the session goes on.
+	msg, err = client.Receive()
+	be.NilErr(t, err)
+	be.Equal(t, typeName(&pgproto3.ReadyForQuery{}), typeName(msg))
+	be.NilErr(t, <-done)
+	be.True(t, cc.serverConn == nil)
+}
+
+func TestReleaseDiscardsNotifications(t *testing.T) {
+	serverEnd, proxyServerEnd := net.Pipe()
+	defer serverEnd.Close()
+	cfg := genBasePoolConfig()
+	cfg.SpawnConn = func(ctx context.Context) (Conner, error) {
+		return &pipeConnMock{conn: proxyServerEnd}, nil
+	}
+	p, err := NewPool(cfg)
+	be.NilErr(t, err)
+	defer p.Close()
+
+	cc := newTestClientConn(nil, nil)
+	cc.mode = PoolModeTransaction
+	cc.pool = p
+	cc.serverConn, err = p.AcquireConn()
+	be.NilErr(t, err)
+
+	// A notification arrives right after the last reply to the client,
+	// and is read along with it.
+	go func() {
+		buf := (&pgproto3.ReadyForQuery{TxStatus: StatusIdle}).Encode(nil)
+		buf = (&pgproto3.NotificationResponse{Channel: "posts", Payload: "secret"}).Encode(buf)
+		serverEnd.Write(buf)
+	}()
+	msg, err := cc.serverConn.Frontend().Receive()
+	be.NilErr(t, err)
+	be.Equal(t, typeName(&pgproto3.ReadyForQuery{}), typeName(msg))
+	cc.mut.Lock()
+	cc.releaseConnLocked()
+	cc.mut.Unlock()
+
+	// The next client of the conn only gets its own replies.
+	sc, err := p.AcquireConn()
+	be.NilErr(t, err)
+	defer p.ReleaseConn(sc)
+	go serverEnd.Write((&pgproto3.ReadyForQuery{TxStatus: StatusIdle}).Encode(nil))
+	msg, err = sc.Frontend().Receive()
+	be.NilErr(t, err)
+	be.Equal(t, typeName(&pgproto3.ReadyForQuery{}), typeName(msg))
+}
+
+func TestKeepsIdleConn(t *testing.T) {
+	cc := newTestClientConn(nil, nil)
+	be.True(t, cc.keepsIdleConn())
+
+	// The replies to a flushed batch belong to the handler.
+	cc.queryStart = time.Now()
+	be.False(t, cc.keepsIdleConn())
+	cc.queryStart = time.Time{}
+
+	// A transaction mode client only keeps its conn while listening.
+	cc.mode = PoolModeTransaction
+	be.False(t, cc.keepsIdleConn())
+	cc.listening = true
+	be.True(t, cc.keepsIdleConn())
+}
+
+// newTestClientConn returns a session mode client conn, which talks
+// to the client on clientConn and holds a server conn on serverConn.
+func newTestClientConn(clientConn, serverConn net.Conn) *ClientConn {
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test"})
+	cc := NewClientConn(
+		pgproto3.NewBackend(clientConn, clientConn),
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		nil,
+		PoolModeSession,
+		&startupParams{session: make(map[string]string)},
+		clientConn,
+		&destMetrics{acquireWait: histogram, queryDuration: histogram, txDuration: histogram},
+	)
+	cc.serverConn = &ServerConn{
+		conn:     &pipeConnMock{conn: serverConn},
+		pool:     &Pool{},
+		state:    sessionState{},
+		prepared: newStmtCache(10),
+	}
+	return cc
+}
+
+type pipeConnMock struct {
+	connMock
+	conn net.Conn
+}
+
+func (mc *pipeConnMock) Conn() net.Conn {
+	return mc.conn
+}
+
+func typeName(msg pgproto3.BackendMessage) string {
+	return fmt.Sprintf("%T", msg)
+}
@@ -1,68 +1,124 @@
 package server
 
 import (
-	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"github.com/agnivade/perseus/config"
 	"github.com/jackc/pgx/v5/pgproto3"
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // Server contains all the necessary information to run Perseus
 type Server struct {
-	cfg    config.Config
-	logger *log.Logger
-
-	wg           sync.WaitGroup
-	ln           net.Listener
+	// cfg is the config in effect. The settings which can not be
+	// reloaded keep the values the server was started with.
+	cfg    atomic.Pointer[config.Config]
+	logger *slog.Logger
+	// logLevel is nil if the logger was passed in with WithLogger.
+	logLevel *slog.LevelVar
+
+	wg sync.WaitGroup
+	ln net.Listener
+	// reloadMut serializes reloads.
+	reloadMut    sync.Mutex
 	connMut      sync.Mutex
 	connMap      map[net.Conn]struct{}
 	clientConnWg sync.WaitGroup
 
+	// clientTLS is swapped on reload, so that new certificates
+	// are picked up without affecting existing connections.
+	clientTLS atomic.Pointer[clientTLS]
+
+	// peerIPs are the resolved addresses of ClusterSettings.Peers.
+	peerIPs atomic.Pointer[[]net.IP]
+
 	keyDataMut sync.Mutex
 	// TODO: later have a custom struct rather than depend on pgproto3
 	keyDataMap map[pgproto3.BackendKeyData]*ClientConn
 
-	authPool *pgxpool.Pool
-	poolMgr  *PoolManager
+	creds CredentialStore
+	// authCache is nil if caching is disabled. Otherwise,
+	// creds points to it.
+	authCache *credentialCache
+	limiter   *loginLimiter
+	poolMgr   *PoolManager
+
+	metrics *metrics
+	// metricsSrv is nil if metrics are not served.
+	metricsSrv *http.Server
+
+	// loadConfig re-reads the config for a reload
+	// triggered from the admin console. It can be nil.
+	loadConfig func() (config.Config, error)
 }
 
 // New creates a new Perseus server
-func New(cfg config.Config) (*Server, error) {
+func New(cfg config.Config, opts ...Option) (*Server, error) {
 	s := &Server{
-		cfg:        cfg,
-		logger:     log.New(os.Stdout, "[perseus] ", log.Lshortfile|log.LstdFlags),
 		connMap:    make(map[net.Conn]struct{}),
 		keyDataMap: make(map[pgproto3.BackendKeyData]*ClientConn),
 	}
+	s.cfg.Store(&cfg)
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.logger == nil {
+		s.logLevel = new(slog.LevelVar)
+		logger, err := newLogger(cfg.LogSettings, os.Stdout, s.logLevel)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing logger: %w", err)
+		}
+		s.logger = logger
+	}
 
-	s.logger.Println("Initializing server..")
-	l, err := net.Listen("tcp", s.cfg.ListenAddress)
+	if id := cfg.ClusterSettings.InstanceID; id < 0 || id > maxInstanceID {
+		return nil, fmt.Errorf("ClusterSettings.InstanceID has to be between 0 and %d, got %d", maxInstanceID, id)
+	}
+
+	s.logger.Info("Initializing server")
+	s.resolvePeers()
+	s.limiter = newLoginLimiter(cfg.SecuritySettings, s.logger)
+	tlsCfg, err := newTLSConfig(cfg.TLSSettings)
 	if err != nil {
-		return nil, fmt.Errorf("error trying to listen on %s: %w", s.cfg.ListenAddress, err)
+		return nil, fmt.Errorf("error initializing TLS config: %w", err)
 	}
-	s.ln = l
+	s.clientTLS.Store(&clientTLS{config: tlsCfg, require: cfg.TLSSettings.Require})
 
-	poolCfg, err := pgxpool.ParseConfig(s.cfg.AuthDBSettings.AuthDBDSN)
+	l, err := net.Listen("tcp", cfg.ListenAddress)
 	if err != nil {
-		return nil, fmt.Errorf("error trying to parse pool config %s: %w", s.cfg.AuthDBSettings.AuthDBDSN, err)
+		return nil, fmt.Errorf("error trying to listen on %s: %w", cfg.ListenAddress, err)
 	}
-	authPool, err := pgxpool.NewWithConfig(context.Background(), poolCfg)
+	s.ln = l
+
+	s.creds, err = NewCredentialStore(cfg.AuthDBSettings)
 	if err != nil {
-		return nil, fmt.Errorf("error initializing auth pool: %w", err)
+		return nil, fmt.Errorf("error initializing credential store: %w", err)
+	}
+	if cfg.AuthDBSettings.CacheTTLSecs > 0 {
+		s.authCache, err = newCredentialCache(s.creds, cfg.AuthDBSettings, s.logger)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing credential cache: %w", err)
+		}
+		s.creds = s.authCache
 	}
-	s.authPool = authPool
 
-	s.poolMgr, err = NewPoolManager(s.cfg, s.logger)
+	s.poolMgr, err = NewPoolManager(cfg, s.logger)
 	if err != nil {
 		return nil, fmt.Errorf("error initializing pool manager: %w", err)
 	}
 
+	s.metrics = newMetrics(s)
+	if addr := cfg.MetricsSettings.ListenAddress; addr != "" {
+		if err := s.serveMetrics(addr); err != nil {
+			return nil, fmt.Errorf("error initializing metrics: %w", err)
+		}
+	}
+
 	return s, nil
 }
 
@@ -89,33 +145,87 @@ func (s *Server) AcceptConns() error {
 				delete(s.connMap, conn)
 				s.connMut.Unlock()
 
+				s.metrics.clientConns.Dec()
 				s.clientConnWg.Done()
 			}()
 
-			s.logger.Println("Accepting new connection")
+			s.logger.Debug("Accepting new connection", "client_addr", c.RemoteAddr().String())
+			s.metrics.clientConns.Inc()
+			s.metrics.clientConnsTotal.Inc()
 			// Populating the conn map.
 			s.connMut.Lock()
 			s.connMap[conn] = struct{}{}
 			s.connMut.Unlock()
 
 			if err := s.handleConn(c); err != nil && err != ErrCancelComplete {
-				s.logger.Printf("error while handling conn: %v\n", err)
+				s.logger.Warn("Error while handling conn", "client_addr", c.RemoteAddr().String(), "err", err)
 			}
 		}(conn)
 	}
 }
 
+// Reload applies the settings of cfg which can be changed at runtime.
+// The other settings keep the values the server was started with.
 func (s *Server) Reload(cfg config.Config) {
-	s.logger.Println("Reloading config.. ")
-	s.poolMgr.Reload(cfg)
+	s.reloadMut.Lock()
+	defer s.reloadMut.Unlock()
+	s.logger.Info("Reloading config")
+	next := *s.cfg.Load()
+	if s.logLevel != nil {
+		if lvl, err := parseLogLevel(cfg.LogSettings.Level); err != nil {
+			s.logger.Error("Error reloading log level, keeping the old one", "err", err)
+		} else {
+			s.logLevel.Set(lvl)
+			next.LogSettings.Level = cfg.LogSettings.Level
+		}
+	}
+	tlsCfg, err := newTLSConfig(cfg.TLSSettings)
+	if err != nil {
+		s.logger.Error("Error reloading TLS config, keeping the old one", "err", err)
+	} else {
+		s.clientTLS.Store(&clientTLS{config: tlsCfg, require: cfg.TLSSettings.Require})
+		next.TLSSettings = cfg.TLSSettings
+	}
+	if r, ok := s.creds.(reloader); ok {
+		if err := r.reload(); err != nil {
+			s.logger.Error("Error reloading credentials", "err", err)
+		}
+	}
+	s.limiter.reload(cfg.SecuritySettings)
+	next.SecuritySettings = cfg.SecuritySettings
+	next.AdminSettings = cfg.AdminSettings
+	next.AuthDBSettings.AuthQueryTimeoutSecs = cfg.AuthDBSettings.AuthQueryTimeoutSecs
+	next.AWSSettings.KMSKeyARN = cfg.AWSSettings.KMSKeyARN
+	next.PoolSettings = cfg.PoolSettings
+	next.OverrideSettings = cfg.OverrideSettings
+	next.TenantSettings = cfg.TenantSettings
+	s.cfg.Store(&next)
+	s.resolvePeers()
+	s.poolMgr.Reload(next)
+}
+
+// SetConfigLoader sets the function which is used to re-read
+// the config when a reload is requested from the admin console.
+func (s *Server) SetConfigLoader(load func() (config.Config, error)) {
+	s.loadConfig = load
+}
+
+// InvalidateCredentialCache drops all cached credentials,
+// forcing them to be looked up again.
+func (s *Server) InvalidateCredentialCache() {
+	if s.authCache != nil {
+		s.authCache.invalidate()
+	}
 }
 
 // Stop stops the server
 func (s *Server) Stop() {
-	s.logger.Println("Shutting down server..")
+	s.logger.Info("Shutting down server")
+
+	s.stopMetrics()
 
 	if err := s.ln.Close(); err != nil {
-		s.logger.Printf("error closing listener %v\n", err)
+		s.logger.Error("Error closing listener", "err", err)
 	}
 
 	// Wait till accept loop exited
@@ -125,7 +235,7 @@ func (s *Server) Stop() {
 	s.connMut.Lock()
 	for conn := range s.connMap {
 		if err := conn.Close(); err != nil {
-			s.logger.Printf("Error closing client connection: %v\n", err)
+			s.logger.Error("Error closing client connection", "err", err)
 		}
 		delete(s.connMap, conn)
 	}
@@ -135,6 +245,8 @@ func (s *Server) Stop() {
 	s.clientConnWg.Wait()
 
 	if err := s.poolMgr.Close(); err != nil {
-		s.logger.Printf("Error closing pool manager: %v\n", err)
+		s.logger.Error("Error closing pool manager", "err", err)
 	}
+
+	s.creds.Close()
 }
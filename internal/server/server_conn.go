@@ -3,11 +3,13 @@ package server
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
 )
 
 type Conner interface {
@@ -16,6 +18,8 @@ type Conner interface {
 	Close(ctx context.Context) error
 	Exec(ctx context.Context, sql string) *pgconn.MultiResultReader
 	CancelRequest(ctx context.Context) error
+	PID() uint32
+	ParameterStatus(key string) string
 }
 
 type ServerConn struct {
@@ -23,6 +27,18 @@ type ServerConn struct {
 	pool *Pool
 
 	createdAt time.Time
+	// generation is the pool generation the conn was opened in.
+	generation uint64
+	// state is the session state last applied to the conn, or nil if it
+	// is not known. It is only accessed by the user of the conn, or by
+	// the pool while the conn is idle.
+	state sessionState
+	// prepared are the statements prepared on the conn by Perseus. Like
+	// state, it is only accessed by the user of the conn, or by the pool.
+	prepared *stmtCache
+	// frontend is kept for the lifetime of the conn, so that
+	// no message read ahead of the one being received is lost.
+	frontend *pgproto3.Frontend
 
 	sync.Mutex // guards following
 	closed     bool
@@ -36,10 +52,73 @@ func (sc *ServerConn) Conn() net.Conn {
 	return sc.conn.Conn()
 }
 
+// Frontend returns the frontend used to exchange
+// protocol messages with the server.
+func (sc *ServerConn) Frontend() *pgproto3.Frontend {
+	if sc.frontend == nil {
+		sc.frontend = pgproto3.NewFrontend(sc.conn.Conn(), sc.conn.Conn())
+	}
+	return sc.frontend
+}
+
+// discardAsync drops the messages the frontend has read ahead, which can
+// only be async ones, like notifications, once the conn is idle. Nothing
+// is read from the network, since the deadline has already passed.
+func (sc *ServerConn) discardAsync() error {
+	if sc.frontend == nil {
+		return nil
+	}
+	conn := sc.conn.Conn()
+	conn.SetReadDeadline(time.Now())
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		msg, err := sc.frontend.Receive()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch msg.(type) {
+		case *pgproto3.NotificationResponse, *pgproto3.ParameterStatus, *pgproto3.NoticeResponse:
+		default:
+			return fmt.Errorf("unexpected %T on an idle conn", msg)
+		}
+	}
+}
+
 func (sc *ServerConn) CheckConn() error {
 	return sc.conn.CheckConn()
 }
 
+// PID returns the process id of the backend.
+func (sc *ServerConn) PID() uint32 {
+	return sc.conn.PID()
+}
+
+// serverConnInfo are the details of a server conn shown by the admin console.
+type serverConnInfo struct {
+	pid       uint32
+	localAddr string
+	createdAt time.Time
+}
+
+// info returns the details of the conn, or false if it is closed. Unlike
+// the other methods, it can be called by others than the user of the conn.
+func (sc *ServerConn) info() (serverConnInfo, bool) {
+	sc.Lock()
+	defer sc.Unlock()
+	if sc.closed {
+		return serverConnInfo{}, false
+	}
+	return serverConnInfo{
+		pid:       sc.conn.PID(),
+		localAddr: sc.conn.Conn().LocalAddr().String(),
+		createdAt: sc.createdAt,
+	}, true
+}
+
 func (sc *ServerConn) CancelRequest(ctx context.Context) error {
 	return sc.conn.CancelRequest(ctx)
 }
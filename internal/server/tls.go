@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/agnivade/perseus/config"
+)
+
+// tlsHandshakeTimeout is the maximum time a client gets to
+// complete the TLS handshake after an SSLRequest.
+const tlsHandshakeTimeout = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// clientTLS is the TLS setup for client connections. Both fields
+// are swapped together on reload, so they always agree.
+type clientTLS struct {
+	// config is nil if TLS is not enabled.
+	config *tls.Config
+	// require rejects clients which do not upgrade to TLS.
+	// It is only set if config is not nil.
+	require bool
+}
+
+// newTLSConfig loads the certificates from the settings and returns
+// a *tls.Config to terminate client connections with.
+// It returns nil if TLS is not enabled.
+func newTLSConfig(settings config.TLSSettings) (*tls.Config, error) {
+	if settings.CertFile == "" && settings.KeyFile == "" {
+		if settings.Require {
+			return nil, errors.New("TLS is required but no certificate is configured")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading key pair: %w", err)
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if settings.MinVersion != "" {
+		v, ok := tlsVersions[settings.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", settings.MinVersion)
+		}
+		minVersion = v
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+	}
+
+	if settings.ClientCAFile != "" {
+		pem, err := os.ReadFile(settings.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", settings.ClientCAFile)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsCfg, nil
+}
+
+// isTLS reports whether the connection has been upgraded to TLS.
+func isTLS(c net.Conn) bool {
+	_, ok := c.(*tls.Conn)
+	return ok
+}
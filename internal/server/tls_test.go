@@ -0,0 +1,165 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/agnivade/perseus/config"
+	"github.com/carlmjohnson/be"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, "perseus")
+
+	tlsCfg, err := newTLSConfig(config.TLSSettings{})
+	be.NilErr(t, err)
+	be.True(t, tlsCfg == nil)
+	_, err = newTLSConfig(config.TLSSettings{Require: true})
+	be.Nonzero(t, err)
+
+	tlsCfg, err = newTLSConfig(config.TLSSettings{CertFile: certFile, KeyFile: keyFile})
+	be.NilErr(t, err)
+	be.Equal(t, uint16(tls.VersionTLS12), tlsCfg.MinVersion)
+	be.Equal(t, tls.NoClientCert, tlsCfg.ClientAuth)
+
+	tlsCfg, err = newTLSConfig(config.TLSSettings{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"})
+	be.NilErr(t, err)
+	be.Equal(t, uint16(tls.VersionTLS13), tlsCfg.MinVersion)
+	_, err = newTLSConfig(config.TLSSettings{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.4"})
+	be.Nonzero(t, err)
+
+	// The self-signed certificate is its own CA.
+	tlsCfg, err = newTLSConfig(config.TLSSettings{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile})
+	be.NilErr(t, err)
+	be.Equal(t, tls.RequireAndVerifyClientCert, tlsCfg.ClientAuth)
+	be.True(t, tlsCfg.ClientCAs != nil)
+	_, err = newTLSConfig(config.TLSSettings{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile})
+	be.Nonzero(t, err)
+}
+
+func TestHandleStartupRequireTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, "perseus")
+	s := newTestTLSServer(t, config.TLSSettings{CertFile: certFile, KeyFile: keyFile, Require: true})
+
+	clientEnd, proxyEnd := net.Pipe()
+	defer clientEnd.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := s.handleStartup(proxyEnd)
+		errCh <- err
+	}()
+
+	client := pgproto3.NewFrontend(clientEnd, clientEnd)
+	_, err := clientEnd.Write(startupMessage().Encode(nil))
+	be.NilErr(t, err)
+	msg, err := client.Receive()
+	be.NilErr(t, err)
+	errResp, ok := msg.(*pgproto3.ErrorResponse)
+	be.True(t, ok)
+	be.Equal(t, codeInvalidAuthorization, errResp.Code)
+	be.Nonzero(t, <-errCh)
+}
+
+func TestReloadTLS(t *testing.T) {
+	oldCert, oldKey := writeTestCert(t, "old")
+	s := newTestTLSServer(t, config.TLSSettings{CertFile: oldCert, KeyFile: oldKey})
+	be.Equal(t, "old", handshakeCN(t, s))
+
+	// New connections get the new certificate.
+	newCert, newKey := writeTestCert(t, "new")
+	s.Reload(config.Config{TLSSettings: config.TLSSettings{CertFile: newCert, KeyFile: newKey}})
+	be.Equal(t, "new", handshakeCN(t, s))
+
+	// A certificate which fails to load keeps the old one.
+	s.Reload(config.Config{TLSSettings: config.TLSSettings{CertFile: newCert, KeyFile: oldCert}})
+	be.Equal(t, "new", handshakeCN(t, s))
+}
+
+// handshakeCN upgrades a client conn to TLS, and returns the
+// common name of the certificate presented by the server.
+func handshakeCN(t *testing.T, s *Server) string {
+	clientEnd, proxyEnd := net.Pipe()
+	defer clientEnd.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := s.handleStartup(proxyEnd)
+		errCh <- err
+	}()
+
+	_, err := clientEnd.Write((&pgproto3.SSLRequest{}).Encode(nil))
+	be.NilErr(t, err)
+	resp := make([]byte, 1)
+	_, err = io.ReadFull(clientEnd, resp)
+	be.NilErr(t, err)
+	be.Equal(t, byte('S'), resp[0])
+
+	tlsConn := tls.Client(clientEnd, &tls.Config{InsecureSkipVerify: true})
+	be.NilErr(t, tlsConn.Handshake())
+	_, err = tlsConn.Write(startupMessage().Encode(nil))
+	be.NilErr(t, err)
+	be.NilErr(t, <-errCh)
+	return tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func newTestTLSServer(t *testing.T, settings config.TLSSettings) *Server {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := &Server{
+		logger:  logger,
+		limiter: newLoginLimiter(config.SecuritySettings{}, logger),
+		poolMgr: &PoolManager{pools: make(map[poolKey]*Pool)},
+	}
+	s.cfg.Store(&config.Config{TLSSettings: settings})
+	tlsCfg, err := newTLSConfig(settings)
+	be.NilErr(t, err)
+	s.clientTLS.Store(&clientTLS{config: tlsCfg, require: settings.Require})
+	return s
+}
+
+func startupMessage() *pgproto3.StartupMessage {
+	return &pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice", "database": "mattermost"},
+	}
+}
+
+// writeTestCert writes a self-signed certificate with the
+// common name, and its key, and returns their paths.
+func writeTestCert(t *testing.T, commonName string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	be.NilErr(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	be.NilErr(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	be.NilErr(t, err)
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	be.NilErr(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	be.NilErr(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}